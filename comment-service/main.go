@@ -10,6 +10,9 @@ import (
 	"os"
 	"time"
 
+	"blog-shared/auth"
+	"blog-shared/userclient"
+
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
@@ -18,14 +21,20 @@ import (
 type Comment struct {
 	ID        int       `json:"id"`
 	PostID    int       `json:"post_id"`
-	UserID    int       `json:"user_id"`
+	UserID    *int      `json:"user_id"` // nil once the author's account is anonymized
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// Author is only filled in for ?expand=author
+	Author *userclient.Author `json:"author,omitempty"`
 }
 
 var db *sql.DB
 
+// userService looks up authors for ?expand=author
+var userService *userclient.Client
+
 func main() {
 	// Set up database connection using environment variables
 	dbUser := getEnv("DB_USER", "postgres")
@@ -38,6 +47,13 @@ func main() {
 		dbUser, dbPassword, dbHost, dbPort, dbName)
 
 	var err error
+	verifier, err = auth.LoadVerifier()
+	if err != nil {
+		log.Fatal(err)
+	}
+	authn.VerifiedEmailRequired = getEnv("REQUIRE_VERIFIED_EMAIL", "true") == "true"
+	userService = userclient.New(getEnv("USER_SERVICE_URL", "http://localhost:8081"), time.Minute)
+
 	db, err = sql.Open("postgres", connectionString)
 	if err != nil {
 		log.Fatal(err)
@@ -60,10 +76,10 @@ func main() {
 	})
 
 	r.HandleFunc("/health", healthCheck).Methods("GET")
-	r.HandleFunc("/posts/{post_id:[0-9]+}/comments", createComment).Methods("POST")
-	r.HandleFunc("/posts/{post_id:[0-9]+}/comments", getComments).Methods("GET")
-	r.HandleFunc("/comments/{id:[0-9]+}", updateComment).Methods("PUT")
-	r.HandleFunc("/comments/{id:[0-9]+}", deleteComment).Methods("DELETE")
+	r.HandleFunc("/posts/{post_id:[0-9]+}/comments", authn.RequireAuth(authn.RequireVerifiedEmail(auth.RequirePermission("comments:write", createComment)))).Methods("POST")
+	r.HandleFunc("/posts/{post_id:[0-9]+}/comments", authn.OptionalAuth(getComments)).Methods("GET")
+	r.HandleFunc("/comments/{id:[0-9]+}", authn.RequireAuth(updateComment)).Methods("PUT")
+	r.HandleFunc("/comments/{id:[0-9]+}", authn.RequireAuth(deleteComment)).Methods("DELETE")
 	r.HandleFunc("/status", healthCheck).Methods("GET")
 	r.HandleFunc("/mystatus", healthCheck).Methods("GET")
 	r.HandleFunc("/checkstatus", healthCheck).Methods("GET")
@@ -124,15 +140,24 @@ func createComment(w http.ResponseWriter, r *http.Request) {
 	// Set the post ID from the URL
 	fmt.Sscanf(postID, "%d", &comment.PostID)
 
+	// The author is always the authenticated caller, never the request body
+	claims, _ := auth.FromContext(r.Context())
+	comment.UserID = &claims.UserID
+
 	// Simple validation
-	if comment.Content == "" || comment.UserID == 0 {
-		http.Error(w, "Content and user_id are required", http.StatusBadRequest)
+	if comment.Content == "" {
+		http.Error(w, "Content is required", http.StatusBadRequest)
 		return
 	}
 
-	// Check if the post exists
+	// Check if the post is published. Drafts, scheduled and archived posts
+	// take no comments. Users the author blocked may still comment, so the
+	// block stays invisible to them; getComments hides it from the author.
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1)", comment.PostID).Scan(&exists)
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1 AND status = 'published')",
+		comment.PostID,
+	).Scan(&exists)
 	if err != nil {
 		http.Error(w, "Error checking post existence: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -162,9 +187,18 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	postID := vars["post_id"]
 
-	// Check if the post exists
+	viewerID, editor := 0, false
+	if claims, ok := auth.FromContext(r.Context()); ok {
+		viewerID, editor = claims.UserID, claims.Can("posts:edit_any")
+	}
+
+	// Check if the post exists and the caller may see it. As in the post
+	// service, only its author and editors see a post that is not published.
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1)", postID).Scan(&exists)
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1 AND (status = 'published' OR user_id = $2 OR $3))",
+		postID, viewerID, editor,
+	).Scan(&exists)
 	if err != nil {
 		http.Error(w, "Error checking post existence: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -174,9 +208,17 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Signed-in readers don't see comments from users they muted or blocked.
+	// Nothing changes for the muted or blocked user, who still sees their own
+	// comments.
 	rows, err := db.Query(
-		"SELECT id, post_id, user_id, content, created_at, updated_at FROM comments WHERE post_id = $1 ORDER BY created_at ASC",
-		postID,
+		`SELECT c.id, c.post_id, c.user_id, c.content, c.created_at, c.updated_at
+		FROM comments c
+		WHERE c.post_id = $1
+			AND NOT EXISTS (SELECT 1 FROM user_mutes m WHERE m.muter_id = $2 AND m.muted_id = c.user_id)
+			AND NOT EXISTS (SELECT 1 FROM user_blocks b WHERE b.blocker_id = $2 AND b.blocked_id = c.user_id)
+		ORDER BY c.created_at ASC`,
+		postID, viewerID,
 	)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -193,6 +235,9 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 		}
 		comments = append(comments, comment)
 	}
+	userService.Expand(r, len(comments),
+		func(i int) *int { return comments[i].UserID },
+		func(i int, author userclient.Author) { comments[i].Author = &author })
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(comments)
@@ -215,6 +260,11 @@ func updateComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only the author or a moderator may change a comment
+	if !authorizeCommentOwner(w, r, id) {
+		return
+	}
+
 	// Update the comment
 	_, err := db.Exec(
 		"UPDATE comments SET content = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
@@ -248,6 +298,11 @@ func deleteComment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	// Only the author or a moderator may delete a comment
+	if !authorizeCommentOwner(w, r, id) {
+		return
+	}
+
 	// Delete the comment
 	result, err := db.Exec("DELETE FROM comments WHERE id = $1", id)
 	if err != nil {
@@ -269,3 +324,25 @@ func deleteComment(w http.ResponseWriter, r *http.Request) {
 	// Return a success message
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// authorizeCommentOwner looks up the author of a comment and writes a 404 or
+// 403 response unless the caller is the author or a moderator
+func authorizeCommentOwner(w http.ResponseWriter, r *http.Request, id string) bool {
+	var ownerID sql.NullInt64
+	err := db.QueryRow("SELECT user_id FROM comments WHERE id = $1", id).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	claims, _ := auth.FromContext(r.Context())
+	if !auth.CanModify(claims, int(ownerID.Int64), "comments:write", "comments:moderate") {
+		http.Error(w, "You do not have permission to modify this comment", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -1,7 +1,244 @@
 package main
 
-import "testing"
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+	"blog-shared/fakedb"
+	"blog-shared/userclient"
+
+	"github.com/gorilla/mux"
+)
 
 func TestHealthCheck(t *testing.T) {
-	_ = 2
+	rec := httptest.NewRecorder()
+	healthCheck(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// useFakeDB points db at a scripted fake for the duration of the test
+func useFakeDB(t *testing.T) *fakedb.DB {
+	t.Helper()
+	return fakedb.Use(t, &db)
+}
+
+var commentColumns = []string{"id", "post_id", "user_id", "content", "created_at", "updated_at"}
+
+func TestCommentOwnershipAuthorization(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+	moderator := testClaims(9)
+	moderator.Permissions = []string{"comments:write", "comments:moderate"}
+	editor := testClaims(8)
+	editor.Permissions = []string{"posts:write", "posts:edit_any", "posts:delete_any"}
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		claims     *auth.Claims
+		ownerID    int64
+		missing    bool
+		wantStatus int
+		wantWrite  string
+	}{
+		{"update without token", updateComment, "PUT", nil, 1, false, http.StatusUnauthorized, ""},
+		{"update by owner", updateComment, "PUT", ptr(testClaims(1)), 1, false, http.StatusOK, "UPDATE comments"},
+		{"update by other user", updateComment, "PUT", ptr(testClaims(2)), 1, false, http.StatusForbidden, ""},
+		{"update by moderator", updateComment, "PUT", &moderator, 1, false, http.StatusOK, "UPDATE comments"},
+		{"update missing comment", updateComment, "PUT", ptr(testClaims(1)), 0, true, http.StatusNotFound, ""},
+		{"delete without token", deleteComment, "DELETE", nil, 1, false, http.StatusUnauthorized, ""},
+		{"delete by owner", deleteComment, "DELETE", ptr(testClaims(1)), 1, false, http.StatusNoContent, "DELETE FROM comments"},
+		{"delete by other user", deleteComment, "DELETE", ptr(testClaims(2)), 1, false, http.StatusForbidden, ""},
+		{"delete by moderator", deleteComment, "DELETE", &moderator, 1, false, http.StatusNoContent, "DELETE FROM comments"},
+		{"delete by post editor", deleteComment, "DELETE", &editor, 1, false, http.StatusForbidden, ""},
+		{"delete missing comment", deleteComment, "DELETE", ptr(testClaims(1)), 0, true, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			if !tt.missing {
+				fake.OnQuery("SELECT user_id FROM comments", []string{"user_id"}, []driver.Value{tt.ownerID})
+			} else {
+				fake.OnQuery("SELECT user_id FROM comments", []string{"user_id"})
+			}
+			fake.OnExec("UPDATE comments", 1)
+			fake.OnExec("DELETE FROM comments", 1)
+			now := time.Now()
+			fake.OnQuery("SELECT id, post_id", commentColumns, []driver.Value{int64(5), int64(3), tt.ownerID, "Nice", now, now})
+
+			req := httptest.NewRequest(tt.method, "/comments/5", strings.NewReader(`{"content":"Nice"}`))
+			req = mux.SetURLVars(req, map[string]string{"id": "5"})
+			if tt.claims != nil {
+				req.Header.Set("Authorization", "Bearer "+signTestToken(t, *tt.claims))
+			}
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(tt.handler)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			for _, write := range []string{"UPDATE comments", "DELETE FROM comments"} {
+				if ran := fake.Ran(write); ran != (write == tt.wantWrite) {
+					t.Errorf("ran %q = %v, want %v", write, ran, !ran)
+				}
+			}
+		})
+	}
+}
+
+func ptr(c auth.Claims) *auth.Claims { return &c }
+
+func TestCreateCommentFromBlockedUser(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+	commenter := testClaims(3)
+	commenter.EmailVerified = true
+	commenter.Permissions = []string{"comments:write"}
+
+	tests := []struct {
+		name       string
+		exists     bool
+		wantStatus int
+	}{
+		// Whether or not the post's author blocked the commenter, they see
+		// their comment accepted
+		{"published post", true, http.StatusCreated},
+		{"missing post", false, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{tt.exists})
+			now := time.Now()
+			fake.OnQuery("INSERT INTO comments", []string{"id", "created_at", "updated_at"}, []driver.Value{int64(12), now, now})
+
+			req := httptest.NewRequest("POST", "/posts/5/comments", strings.NewReader(`{"content":"Hello"}`))
+			req = mux.SetURLVars(req, map[string]string{"post_id": "5"})
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, commenter))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(createComment)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if fake.Ran("INSERT INTO comments") != (tt.wantStatus == http.StatusCreated) {
+				t.Errorf("comment inserted = %v", fake.Ran("INSERT INTO comments"))
+			}
+			if fake.Ran("user_blocks") {
+				t.Error("creating a comment consulted the author's blocks")
+			}
+		})
+	}
+}
+
+func TestGetCommentsViewer(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+	for _, auth := range []string{"", "Bearer " + signTestToken(t, testClaims(3))} {
+		fake := useFakeDB(t)
+		fake.OnQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{true})
+		now := time.Now()
+		fake.OnQuery("FROM comments c", commentColumns, []driver.Value{int64(1), int64(5), int64(2), "Hi", now, now})
+
+		req := httptest.NewRequest("GET", "/posts/5/comments", nil)
+		req = mux.SetURLVars(req, map[string]string{"post_id": "5"})
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		authn.OptionalAuth(getComments)(rec, req)
+
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"content":"Hi"`) {
+			t.Fatalf("authenticated=%v: status = %d (%s)", auth != "", rec.Code, rec.Body.String())
+		}
+		if !fake.Ran("user_mutes") || !fake.Ran("user_blocks") {
+			t.Error("comments were not filtered by the viewer's mutes and blocks")
+		}
+		// Only the viewer's own blocks apply, so a blocked user still sees
+		// their comments on the blocker's posts
+		wantViewer := int64(0)
+		if auth != "" {
+			wantViewer = 3
+		}
+		if args := fake.Args("FROM comments c"); len(args) != 2 || args[1] != wantViewer {
+			t.Errorf("comments filtered for viewer %v, want %d", args, wantViewer)
+		}
+	}
+}
+
+func TestGetCommentsUnpublishedPost(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+	editor := testClaims(8)
+	editor.Permissions = []string{"posts:write", "posts:edit_any"}
+	tests := []struct {
+		name       string
+		auth       string
+		visible    bool
+		wantStatus int
+	}{
+		{"anonymous", "", false, http.StatusNotFound},
+		{"reader", "Bearer " + signTestToken(t, testClaims(3)), false, http.StatusNotFound},
+		{"editor", "Bearer " + signTestToken(t, editor), true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{tt.visible})
+			fake.OnQuery("FROM comments c", commentColumns)
+
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/posts/5/comments", nil), map[string]string{"post_id": "5"})
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			authn.OptionalAuth(getComments)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if !fake.Ran("OR user_id = $2 OR $3") {
+				t.Error("visibility check ignores posts:edit_any")
+			}
+		})
+	}
+}
+
+func TestGetCommentsExpandAuthor(t *testing.T) {
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"users":[{"id":2,"username":"jane_smith"}]}`))
+	}))
+	defer users.Close()
+	userService = userclient.New(users.URL, 0)
+
+	fake := useFakeDB(t)
+	fake.OnQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{true})
+	now := time.Now()
+	fake.OnQuery("FROM comments c", commentColumns, []driver.Value{int64(1), int64(5), int64(2), "Hi", now, now})
+
+	req := httptest.NewRequest("GET", "/posts/5/comments?expand=author", nil)
+	req = mux.SetURLVars(req, map[string]string{"post_id": "5"})
+	rec := httptest.NewRecorder()
+	getComments(rec, req)
+
+	if !strings.Contains(rec.Body.String(), `"author":{"id":2,"username":"jane_smith"}`) {
+		t.Errorf("author not embedded: %s", rec.Body.String())
+	}
+
+	// Comments are still served when the user-service is down
+	users.Close()
+	rec = httptest.NewRecorder()
+	getComments(rec, req)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"author"`) {
+		t.Errorf("status = %d, body %s; want comments without authors", rec.Code, rec.Body.String())
+	}
 }
@@ -6,25 +6,83 @@ CREATE DATABASE IF NOT EXISTS blogdb;
 -- Connect to the newly created database
 \c blogdb;
 
+-- Trigram matching for the user directory search
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 -- Create tables
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(50) UNIQUE NOT NULL,
     email VARCHAR(100) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    email_verified_at TIMESTAMP WITH TIME ZONE,
+    display_name VARCHAR(100) NOT NULL DEFAULT '',
+    bio TEXT NOT NULL DEFAULT '',
+    links TEXT[] NOT NULL DEFAULT '{}',
+    avatar_url VARCHAR(500) NOT NULL DEFAULT '',
+    avatar_key VARCHAR(200),
+    show_email BOOLEAN NOT NULL DEFAULT FALSE,
+    deletion_scheduled_for TIMESTAMP WITH TIME ZONE,
+    deletion_mode VARCHAR(20),
+    -- Published posts, kept up to date by the posts_post_count triggers
+    post_count INTEGER NOT NULL DEFAULT 0,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Slugs are unique among siblings, see idx_categories_parent_slug
+CREATE TABLE categories (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    slug VARCHAR(100) NOT NULL,
+    parent_id INTEGER REFERENCES categories(id)
+);
+
 CREATE TABLE posts (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
     title VARCHAR(255) NOT NULL,
     content TEXT NOT NULL,
+    -- Text search configuration the post is written in
+    language REGCONFIG NOT NULL DEFAULT 'english',
+    -- Title matches rank above content matches
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector(language, title), 'A') || setweight(to_tsvector(language, content), 'B')
+    ) STORED,
+    category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+    -- Only published posts are public; scheduled ones are published at publish_at
+    status VARCHAR(20) NOT NULL DEFAULT 'published'
+        CHECK (status IN ('draft', 'scheduled', 'published', 'archived')),
+    publish_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        CHECK (status NOT IN ('scheduled', 'published') OR publish_at IS NOT NULL),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Tag names are stored normalized: lower case, words joined by hyphens
+CREATE TABLE tags (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL
+);
+
+CREATE TABLE post_tags (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (post_id, tag_id)
+);
+
+-- Every saved version of a post's title and content, numbered from 1 per post
+CREATE TABLE post_revisions (
+    id SERIAL PRIMARY KEY,
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    content TEXT NOT NULL,
+    editor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (post_id, revision)
+);
+
 CREATE TABLE comments (
     id SERIAL PRIMARY KEY,
     post_id INTEGER REFERENCES posts(id) ON DELETE CASCADE,
@@ -34,15 +92,272 @@ CREATE TABLE comments (
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    revoked_reason VARCHAR(50)
+);
+
+-- Every refresh token ever issued for a session, stored as a SHA-256 hash.
+-- Used tokens are kept so that a replay can be detected.
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    session_id INTEGER NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE password_reset_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE email_verification_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE permissions (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE user_roles (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    granted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    granted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- TOTP secrets are AES-GCM encrypted with TOTP_ENCRYPTION_KEY. last_used_step
+-- is the most recent accepted time step, so a code cannot be used twice.
+CREATE TABLE user_totp (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret_encrypted TEXT NOT NULL,
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_totp(user_id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (user_id, code_hash)
+);
+
+-- Issued after a correct password when the account has two-factor enabled
+CREATE TABLE mfa_challenges (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Long-lived API credentials for scripts. Only the SHA-256 hash is stored;
+-- token_prefix is shown to help users tell their tokens apart.
+CREATE TABLE personal_access_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    token_prefix VARCHAR(20) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+-- External accounts (OpenID Connect subjects) linked to users
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(100),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, subject)
+);
+
+-- In-flight authorization code logins, deleted when the provider redirects back
+CREATE TABLE oidc_login_states (
+    id SERIAL PRIMARY KEY,
+    state_hash CHAR(64) UNIQUE NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    link_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Failed login counters, keyed by 'email:<address>' or 'ip:<address>'
+CREATE TABLE login_throttles (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE security_events (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    event_type VARCHAR(50) NOT NULL,
+    ip_address VARCHAR(45),
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE follows (
+    follower_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    followee_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (follower_id, followee_id),
+    CHECK (follower_id <> followee_id)
+);
+
+CREATE TABLE user_blocks (
+    blocker_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    blocked_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker_id, blocked_id),
+    CHECK (blocker_id <> blocked_id)
+);
+
+CREATE TABLE user_mutes (
+    muter_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    muted_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (muter_id, muted_id),
+    CHECK (muter_id <> muted_id)
+);
+
+-- Usernames a user has given up, reserved for them until reserved_until
+CREATE TABLE username_history (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    old_username VARCHAR(50) NOT NULL,
+    changed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reserved_until TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
 -- Create indexes for better performance
-CREATE INDEX idx_posts_user_id ON posts(user_id);
+CREATE INDEX idx_users_deletion_scheduled_for ON users(deletion_scheduled_for) WHERE deletion_scheduled_for IS NOT NULL;
+CREATE INDEX idx_posts_published ON posts(publish_at DESC, id DESC) WHERE status = 'published';
+CREATE INDEX idx_posts_publish_at ON posts(publish_at) WHERE status = 'scheduled';
+CREATE INDEX idx_posts_user_id_publish_at ON posts(user_id, publish_at DESC, id DESC);
+CREATE INDEX idx_posts_search_vector ON posts USING gin (search_vector);
+CREATE INDEX idx_posts_category_id_publish_at ON posts(category_id, publish_at DESC, id DESC);
+CREATE INDEX idx_post_tags_tag_id ON post_tags(tag_id, post_id);
+CREATE UNIQUE INDEX idx_categories_parent_slug ON categories(COALESCE(parent_id, 0), slug);
 CREATE INDEX idx_comments_post_id ON comments(post_id);
 CREATE INDEX idx_comments_user_id ON comments(user_id);
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+CREATE INDEX idx_user_roles_role_id ON user_roles(role_id);
+CREATE INDEX idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+CREATE INDEX idx_email_verification_tokens_user_id ON email_verification_tokens(user_id);
+CREATE INDEX idx_mfa_challenges_user_id ON mfa_challenges(user_id);
+CREATE INDEX idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
+CREATE INDEX idx_security_events_user_id ON security_events(user_id);
+CREATE INDEX idx_users_created_at ON users(created_at, id);
+CREATE UNIQUE INDEX idx_users_username_lower ON users(lower(username));
+CREATE INDEX idx_username_history_old_username ON username_history(lower(old_username), changed_at DESC);
+CREATE INDEX idx_username_history_user_id ON username_history(user_id, changed_at DESC);
+CREATE INDEX idx_users_username_trgm ON users USING gin (username gin_trgm_ops);
+CREATE INDEX idx_users_display_name_trgm ON users USING gin (display_name gin_trgm_ops);
+CREATE INDEX idx_follows_follower ON follows(follower_id, created_at DESC, followee_id DESC);
+CREATE INDEX idx_follows_followee ON follows(followee_id, created_at DESC, follower_id DESC);
+CREATE INDEX idx_users_post_count ON users(post_count, id);
+
+-- Keep users.post_count in step with the author's published posts
+CREATE FUNCTION update_user_post_count() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.status = 'published' THEN
+        UPDATE users SET post_count = post_count - 1 WHERE id = OLD.user_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.status = 'published' THEN
+        UPDATE users SET post_count = post_count + 1 WHERE id = NEW.user_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER posts_post_count AFTER INSERT OR DELETE ON posts
+    FOR EACH ROW EXECUTE FUNCTION update_user_post_count();
+CREATE TRIGGER posts_post_count_update AFTER UPDATE OF status, user_id ON posts
+    FOR EACH ROW WHEN (OLD.status IS DISTINCT FROM NEW.status OR OLD.user_id IS DISTINCT FROM NEW.user_id)
+    EXECUTE FUNCTION update_user_post_count();
+
+-- Seed the role and permission model
+INSERT INTO roles (name, description) VALUES
+('admin', 'Full access, including managing users and roles'),
+('editor', 'Can edit and delete any post and manage tags and categories'),
+('moderator', 'Can edit and delete any comment'),
+('author', 'Can publish posts and comment'),
+('reader', 'Can comment on posts');
+
+INSERT INTO permissions (name, description) VALUES
+('posts:write', 'Create posts and manage your own'),
+('posts:edit_any', 'Edit posts written by anyone'),
+('posts:delete_any', 'Delete posts written by anyone'),
+('comments:write', 'Create comments and manage your own'),
+('comments:moderate', 'Edit and delete comments written by anyone'),
+('users:manage', 'Manage user accounts and role assignments'),
+('taxonomy:manage', 'Merge and delete tags and manage categories');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p WHERE
+    r.name = 'admin'
+    OR (r.name = 'editor' AND p.name IN ('posts:write', 'posts:edit_any', 'posts:delete_any', 'comments:write', 'taxonomy:manage'))
+    OR (r.name = 'moderator' AND p.name IN ('comments:write', 'comments:moderate'))
+    OR (r.name = 'author' AND p.name IN ('posts:write', 'comments:write'))
+    OR (r.name = 'reader' AND p.name IN ('comments:write'));
 
 -- Insert some sample data
-INSERT INTO users (username, email, password_hash) VALUES 
-('john_doe', 'john@example.com', '$2a$10$1qAz2wSx3eDc4rFv5tGb5edDmJnZczZJHlfKcHKxZ.sU9IMFkxmLK'), -- password: password123
-('jane_smith', 'jane@example.com', '$2a$10$1qAz2wSx3eDc4rFv5tGb5edDmJnZczZJHlfKcHKxZ.sU9IMFkxmLK');
+INSERT INTO users (username, email, password_hash, email_verified_at) VALUES 
+('john_doe', 'john@example.com', '$2a$10$1qAz2wSx3eDc4rFv5tGb5edDmJnZczZJHlfKcHKxZ.sU9IMFkxmLK', CURRENT_TIMESTAMP), -- password: password123
+('jane_smith', 'jane@example.com', '$2a$10$1qAz2wSx3eDc4rFv5tGb5edDmJnZczZJHlfKcHKxZ.sU9IMFkxmLK', CURRENT_TIMESTAMP);
+
+INSERT INTO user_roles (user_id, role_id)
+SELECT 1, id FROM roles WHERE name = 'admin'
+UNION ALL
+SELECT 2, id FROM roles WHERE name = 'author';
 
 INSERT INTO posts (user_id, title, content) VALUES 
 (1, 'First Post', 'This is my first blog post. Welcome to my blog!'),
@@ -50,4 +365,7 @@ INSERT INTO posts (user_id, title, content) VALUES
 
 INSERT INTO comments (post_id, user_id, content) VALUES 
 (1, 2, 'Great first post!'),
-(2, 1, 'Welcome to the blogging world!');
\ No newline at end of file
+(2, 1, 'Welcome to the blogging world!');
+
+INSERT INTO post_revisions (post_id, revision, title, content, editor_id, created_at)
+SELECT id, 1, title, content, user_id, created_at FROM posts;
@@ -0,0 +1,19 @@
+// Access token checks (auth.go)
+package main
+
+import (
+	"database/sql"
+
+	"blog-shared/auth"
+)
+
+var verifier *auth.Verifier
+
+// authn checks bearer tokens, personal access tokens included, against
+// verifier and the sessions in db. See blog-shared/auth.
+var authn = &auth.Authenticator{
+	Parse:                 func(token string) (*auth.Claims, error) { return verifier.Parse(token) },
+	DB:                    func() *sql.DB { return db },
+	PersonalTokens:        true,
+	VerifiedEmailRequired: true,
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// signTestToken builds an HS256 token the way user-service does
+func signTestToken(t *testing.T, claims auth.Claims) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func testClaims(userID int) auth.Claims {
+	return auth.Claims{
+		Subject:   strconv.Itoa(userID),
+		Issuer:    "blog-user-service",
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		UserID:    userID,
+		Username:  "user" + strconv.Itoa(userID),
+	}
+}
+
+// The token checks themselves are tested in blog-shared/auth; this only
+// checks that the service accepts personal access tokens from its database
+func TestRequireAuthPersonalToken(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnQuery("FROM personal_access_tokens", []string{"id", "user_id", "username", "email_verified", "perms"},
+		[]driver.Value{int64(3), int64(7), "alice", true, "{posts:write}"})
+	fake.OnExec("UPDATE personal_access_tokens", 1)
+
+	var got *auth.Claims
+	req := httptest.NewRequest("POST", "/posts", nil)
+	req.Header.Set("Authorization", "Bearer blog_pat_abc")
+	rec := httptest.NewRecorder()
+	authn.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = auth.FromContext(r.Context())
+	})(rec, req)
+
+	if rec.Code != http.StatusOK || got.PersonalTokenID != 3 {
+		t.Fatalf("status = %d, claims = %+v", rec.Code, got)
+	}
+}
@@ -0,0 +1,338 @@
+// Hierarchical post categories (categories.go)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const maxCategoryNameLength = 100
+
+var errCategoryNotFound = errors.New("Category not found")
+
+// Category is a node in the category tree. Slugs are unique among siblings.
+type Category struct {
+	ID       int         `json:"id"`
+	Name     string      `json:"name"`
+	Slug     string      `json:"slug"`
+	ParentID *int        `json:"parent_id"`
+	Children []*Category `json:"children,omitempty"`
+}
+
+// CategoryRequest creates, renames or moves a category. A nil ParentID
+// makes it a top-level category.
+type CategoryRequest struct {
+	Name     string `json:"name"`
+	ParentID *int   `json:"parent_id"`
+}
+
+// categorySubtree selects the ids of a category and all of its descendants.
+// The placeholder is the id of the category. UNION rather than UNION ALL
+// makes the recursion stop even if the tree somehow holds a cycle.
+const categorySubtree = `WITH RECURSIVE subtree AS (
+		SELECT id FROM categories WHERE id = %[1]s
+		UNION
+		SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+	) SELECT id FROM subtree`
+
+// getCategories returns the whole category tree
+func getCategories(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id, name, slug, parent_id FROM categories")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var all []*Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.ParentID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		all = append(all, &c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(categoryTree(all))
+}
+
+// categoryTree links categories to their parents and returns the roots,
+// with siblings sorted by name
+func categoryTree(all []*Category) []*Category {
+	sort.Slice(all, func(i, j int) bool {
+		return strings.ToLower(all[i].Name) < strings.ToLower(all[j].Name)
+	})
+	byID := make(map[int]*Category, len(all))
+	for _, c := range all {
+		byID[c.ID] = c
+	}
+	roots := []*Category{}
+	for _, c := range all {
+		if c.ParentID != nil {
+			if parent, ok := byID[*c.ParentID]; ok {
+				parent.Children = append(parent.Children, c)
+				continue
+			}
+		}
+		roots = append(roots, c)
+	}
+	return roots
+}
+
+// createCategory adds a category under ParentID, or at the top level
+func createCategory(w http.ResponseWriter, r *http.Request) {
+	var req CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	category, ok := validateCategory(w, req)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The parent cannot be deleted while its new subcategory goes in
+	if category.ParentID != nil && !lockCategories(w, tx) {
+		return
+	}
+	if !checkCategoryPlacement(w, tx, 0, category) {
+		return
+	}
+	err = tx.QueryRow(
+		"INSERT INTO categories (name, slug, parent_id) VALUES ($1, $2, $3) RETURNING id",
+		category.Name, category.Slug, category.ParentID,
+	).Scan(&category.ID)
+	if err != nil {
+		writeCategoryError(w, "creating", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error creating category: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+// updateCategory renames a category or moves it, with its subtree, under
+// another parent
+func updateCategory(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var req CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	category, ok := validateCategory(w, req)
+	if !ok {
+		return
+	}
+	category.ID = id
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// A category cannot become its own ancestor. Moves take turns, since two
+	// concurrent ones could each pass the check and together close a loop.
+	if category.ParentID != nil {
+		if !lockCategories(w, tx) {
+			return
+		}
+		var cycle bool
+		err := tx.QueryRow(
+			"SELECT $2 IN ("+fmt.Sprintf(categorySubtree, "$1")+")", id, *category.ParentID,
+		).Scan(&cycle)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if cycle {
+			http.Error(w, "A category cannot be moved under itself", http.StatusBadRequest)
+			return
+		}
+	}
+	if !checkCategoryPlacement(w, tx, id, category) {
+		return
+	}
+
+	result, err := tx.Exec(
+		"UPDATE categories SET name = $1, slug = $2, parent_id = $3 WHERE id = $4",
+		category.Name, category.Slug, category.ParentID, id,
+	)
+	if err != nil {
+		writeCategoryError(w, "updating", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, errCategoryNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error updating category: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(category)
+}
+
+// deleteCategory removes a category without subcategories. Its posts are
+// left uncategorized.
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// No subcategory may be created or moved in between the check and the delete
+	if !lockCategories(w, tx) {
+		return
+	}
+	var hasChildren bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE parent_id = $1)", id).Scan(&hasChildren); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hasChildren {
+		http.Error(w, "Move or delete the subcategories first", http.StatusConflict)
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM categories WHERE id = $1", id)
+	if err != nil {
+		writeCategoryError(w, "deleting", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, errCategoryNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error deleting category: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockCategories makes writes that depend on the shape of the tree take
+// turns. The lock mode conflicts with itself but not with readers.
+func lockCategories(w http.ResponseWriter, tx *sql.Tx) bool {
+	if _, err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// writeCategoryError responds to an error writing a category. A sibling
+// with the same slug that slipped in after checkCategoryPlacement is a
+// conflict, like one found by it.
+func writeCategoryError(w http.ResponseWriter, action string, err error) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		http.Error(w, "A category with this name already exists here", http.StatusConflict)
+		return
+	}
+	http.Error(w, "Error "+action+" category: "+err.Error(), http.StatusInternalServerError)
+}
+
+// validateCategory checks a category request and derives its slug
+func validateCategory(w http.ResponseWriter, req CategoryRequest) (Category, bool) {
+	name := strings.TrimSpace(req.Name)
+	slug := slugify(name)
+	if slug == "" {
+		http.Error(w, "Name must contain a letter or digit", http.StatusBadRequest)
+		return Category{}, false
+	}
+	if utf8.RuneCountInString(name) > maxCategoryNameLength || utf8.RuneCountInString(slug) > maxCategoryNameLength {
+		http.Error(w, fmt.Sprintf("Name must be at most %d characters", maxCategoryNameLength), http.StatusBadRequest)
+		return Category{}, false
+	}
+	return Category{Name: name, Slug: slug, ParentID: req.ParentID}, true
+}
+
+// checkCategoryPlacement writes a 400 or 409 response unless the parent
+// exists and no sibling other than category id already has the slug
+func checkCategoryPlacement(w http.ResponseWriter, tx *sql.Tx, id int, category Category) bool {
+	if category.ParentID != nil {
+		if err := checkCategory(tx, *category.ParentID); err != nil {
+			if err == errCategoryNotFound {
+				http.Error(w, "Parent category not found", http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return false
+		}
+	}
+
+	var taken bool
+	err := tx.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM categories WHERE parent_id IS NOT DISTINCT FROM $1 AND slug = $2 AND id <> $3)",
+		category.ParentID, category.Slug, id,
+	).Scan(&taken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if taken {
+		http.Error(w, "A category with this name already exists here", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// checkPostCategory writes a 400 response unless the category a post is
+// being filed under exists
+func checkPostCategory(w http.ResponseWriter, tx *sql.Tx, id int) bool {
+	if err := checkCategory(tx, id); err != nil {
+		if err == errCategoryNotFound {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
+
+// checkCategory returns errCategoryNotFound unless the category exists
+func checkCategory(tx *sql.Tx, id int) error {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errCategoryNotFound
+	}
+	return nil
+}
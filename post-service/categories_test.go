@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+func TestCategoryTree(t *testing.T) {
+	one, four := 1, 4
+	roots := categoryTree([]*Category{
+		{ID: 3, Name: "frontend", ParentID: &one},
+		{ID: 1, Name: "Tech"},
+		{ID: 4, Name: "Backend", ParentID: &one},
+		{ID: 2, Name: "Life"},
+		{ID: 5, Name: "Go", ParentID: &four},
+	})
+	if len(roots) != 2 || roots[0].Name != "Life" || roots[1].Name != "Tech" {
+		t.Fatalf("roots = %+v", roots)
+	}
+	tech := roots[1]
+	if len(tech.Children) != 2 || tech.Children[0].Name != "Backend" || tech.Children[1].Name != "frontend" {
+		t.Fatalf("Tech children = %+v", tech.Children)
+	}
+	if len(tech.Children[0].Children) != 1 || tech.Children[0].Children[0].ID != 5 {
+		t.Errorf("Backend children = %+v", tech.Children[0].Children)
+	}
+}
+
+func TestCreateCategory(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		parentExists bool
+		taken        bool
+		insertErr    error
+		wantStatus   int
+	}{
+		{"top level", `{"name":"Tech"}`, false, false, nil, http.StatusCreated},
+		{"subcategory", `{"name":"Go","parent_id":1}`, true, false, nil, http.StatusCreated},
+		{"missing parent", `{"name":"Go","parent_id":9}`, false, false, nil, http.StatusBadRequest},
+		{"duplicate sibling", `{"name":"Tech"}`, false, true, nil, http.StatusConflict},
+		{"duplicate sibling created concurrently", `{"name":"Tech"}`, false, false,
+			&pq.Error{Code: "23505", Constraint: "idx_categories_parent_slug"}, http.StatusConflict},
+		{"no name", `{"name":" - "}`, false, false, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("FROM categories WHERE id = $1", []string{"exists"}, []driver.Value{tt.parentExists})
+			fake.OnQuery("parent_id IS NOT DISTINCT FROM", []string{"exists"}, []driver.Value{tt.taken})
+			fake.OnExec("LOCK TABLE categories", 0)
+			if tt.insertErr != nil {
+				fake.OnError("INSERT INTO categories", tt.insertErr)
+			}
+			fake.OnQuery("INSERT INTO categories", []string{"id"}, []driver.Value{int64(7)})
+
+			rec := httptest.NewRecorder()
+			createCategory(rec, httptest.NewRequest("POST", "/categories", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if ran := fake.Ran("INSERT INTO categories"); ran != (tt.wantStatus == http.StatusCreated || tt.insertErr != nil) {
+				t.Errorf("inserted = %v", ran)
+			}
+			// Subcategories lock out a concurrent delete of their parent
+			if locked := fake.Ran("LOCK TABLE categories"); locked != strings.Contains(tt.body, "parent_id") {
+				t.Errorf("locked categories = %v", locked)
+			}
+		})
+	}
+}
+
+func TestUpdateCategoryRejectsCycles(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnExec("LOCK TABLE categories", 0)
+	fake.OnQuery("WITH RECURSIVE subtree", []string{"cycle"}, []driver.Value{true})
+	fake.OnExec("UPDATE categories", 1)
+
+	req := httptest.NewRequest("PUT", "/categories/1", strings.NewReader(`{"name":"Tech","parent_id":5}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rec := httptest.NewRecorder()
+	updateCategory(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d (%s)", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+	if fake.Ran("UPDATE categories") {
+		t.Error("category was moved under its own descendant")
+	}
+	if !fake.Ran("LOCK TABLE categories") {
+		t.Error("cycle check ran without locking out concurrent moves")
+	}
+}
+
+func TestDeleteCategory(t *testing.T) {
+	tests := []struct {
+		name        string
+		hasChildren bool
+		deleted     int64
+		wantStatus  int
+	}{
+		{"leaf", false, 1, http.StatusNoContent},
+		{"with subcategories", true, 1, http.StatusConflict},
+		{"missing", false, 0, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("LOCK TABLE categories", 0)
+			fake.OnQuery("WHERE parent_id = $1", []string{"exists"}, []driver.Value{tt.hasChildren})
+			fake.OnExec("DELETE FROM categories", tt.deleted)
+
+			req := mux.SetURLVars(httptest.NewRequest("DELETE", "/categories/1", nil), map[string]string{"id": "1"})
+			rec := httptest.NewRecorder()
+			deleteCategory(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if fake.Ran("DELETE FROM categories") == tt.hasChildren {
+				t.Errorf("deleted = %v with subcategories = %v", fake.Ran("DELETE FROM categories"), tt.hasChildren)
+			}
+			// Like moves, the children check must not race a new subcategory
+			if !fake.Ran("LOCK TABLE categories") {
+				t.Error("children check ran without locking out concurrent creates and moves")
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Line and word diffs between post revisions (diff.go)
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// These bound the time and memory diffTokens spends. Past any of them the
+// differing middle of the texts is shown as a whole deletion followed by a
+// whole insertion.
+const (
+	maxDiffTokens = 20000   // tokens of both texts left after the common prefix and suffix
+	maxDiffEdits  = 2000    // edits the search looks for
+	maxDiffTrace  = 1 << 20 // furthest points kept in total to walk the path back
+)
+
+// DiffChunk is a run of text that is unchanged, inserted or deleted
+type DiffChunk struct {
+	Op   string `json:"op"` // equal, insert or delete
+	Text string `json:"text"`
+}
+
+// splitLines splits text into lines, each keeping its newline
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// splitWords splits text into words and the runs of whitespace between
+// them, so joining the pieces gives back the text
+func splitWords(text string) []string {
+	var words []string
+	start, space := 0, false
+	for i, r := range text {
+		if i > start && unicode.IsSpace(r) != space {
+			words = append(words, text[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(text) {
+		words = append(words, text[start:])
+	}
+	return words
+}
+
+// diffTokens returns the shortest edit script turning a into b as chunks of
+// joined tokens, using Myers' O(ND) algorithm
+func diffTokens(a, b []string) []DiffChunk {
+	// The common prefix and suffix take no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, t := range a[:prefix] {
+		ops = append(ops, diffOp{"equal", t})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, t := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{"equal", t})
+	}
+
+	chunks := []DiffChunk{}
+	for _, op := range ops {
+		if n := len(chunks); n > 0 && chunks[n-1].Op == op.op {
+			chunks[n-1].Text += op.token
+			continue
+		}
+		chunks = append(chunks, DiffChunk{Op: op.op, Text: op.token})
+	}
+	return chunks
+}
+
+type diffOp struct {
+	op    string
+	token string
+}
+
+// myersDiff finds the edit script by growing, for each number of edits d,
+// the furthest reaching path on every diagonal k = x - y. The furthest
+// points of each round are kept to walk the path back afterwards.
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	if n+m > maxDiffTokens {
+		return replaceAll(a, b)
+	}
+	limit := n + m
+	if limit > maxDiffEdits {
+		limit = maxDiffEdits
+	}
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int // trace[d][k+d] is the furthest x on diagonal k after d edits
+	traced := 0
+
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // down: insert from b
+			} else {
+				x = v[offset+k-1] + 1 // right: delete from a
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, d)
+			}
+		}
+		if traced += 2*d + 1; traced > maxDiffTrace {
+			break
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	// Too far apart to be worth the search
+	return replaceAll(a, b)
+}
+
+// replaceAll deletes all of a and then inserts all of b
+func replaceAll(a, b []string) []diffOp {
+	var ops []diffOp
+	for _, t := range a {
+		ops = append(ops, diffOp{"delete", t})
+	}
+	for _, t := range b {
+		ops = append(ops, diffOp{"insert", t})
+	}
+	return ops
+}
+
+// backtrack follows the path myersDiff found, with the given number of
+// edits, back from the end to the start
+func backtrack(a, b []string, trace [][]int, edits int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := edits; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{"equal", a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{"insert", b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{"delete", a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{"equal", a[x-1]})
+		x--
+		y--
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	got := splitWords("Hello,  big\nworld ")
+	want := []string{"Hello,", "  ", "big", "\n", "world", " "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitWords = %q, want %q", got, want)
+	}
+	if got := splitLines("a\nb\n"); !reflect.DeepEqual(got, []string{"a\n", "b\n"}) {
+		t.Errorf("splitLines = %q", got)
+	}
+}
+
+func TestDiffTokens(t *testing.T) {
+	got := diffTokens(splitWords("the quick brown fox"), splitWords("the slow brown fox jumps"))
+	want := []DiffChunk{
+		{"equal", "the "},
+		{"delete", "quick"},
+		{"insert", "slow"},
+		{"equal", " brown fox"},
+		{"insert", " jumps"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffTokens = %+v, want %+v", got, want)
+	}
+	if got := diffTokens(nil, nil); len(got) != 0 {
+		t.Errorf("diff of nothing = %+v", got)
+	}
+}
+
+// TestDiffTokensMinimal checks random diffs against the edit distance
+// computed from the longest common subsequence
+func TestDiffTokensMinimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func() []string {
+		tokens := make([]string, rng.Intn(12))
+		for i := range tokens {
+			tokens[i] = string(rune('a' + rng.Intn(3)))
+		}
+		return tokens
+	}
+	for i := 0; i < 500; i++ {
+		a, b := random(), random()
+		chunks := diffTokens(a, b)
+
+		var before, after strings.Builder
+		edits := 0
+		for _, c := range chunks {
+			if c.Op != "insert" {
+				before.WriteString(c.Text)
+			}
+			if c.Op != "delete" {
+				after.WriteString(c.Text)
+			}
+			if c.Op != "equal" {
+				edits += len(c.Text)
+			}
+		}
+		if before.String() != strings.Join(a, "") || after.String() != strings.Join(b, "") {
+			t.Fatalf("diff of %q and %q does not rebuild them: %+v", a, b, chunks)
+		}
+		if want := len(a) + len(b) - 2*lcsLength(a, b); edits != want {
+			t.Fatalf("diff of %q and %q has %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+func TestDiffTokensTooLarge(t *testing.T) {
+	numbered := func(prefix string, n int) []string {
+		tokens := make([]string, n)
+		for i := range tokens {
+			tokens[i] = prefix + strconv.Itoa(i) + "\n"
+		}
+		return tokens
+	}
+	// Only the first and last line differ, but too many lines lie between
+	// them to search
+	shared := numbered("line", maxDiffTokens/2)
+	long := [2][]string{
+		append(append([]string{"x\n"}, shared...), "x\n"),
+		append(append([]string{"y\n"}, shared...), "y\n"),
+	}
+	// Few enough lines, but all of them differ
+	distant := [2][]string{numbered("a", 800), numbered("b", 800)}
+
+	for _, texts := range [][2][]string{long, distant} {
+		a, b := texts[0], texts[1]
+		want := []DiffChunk{{Op: "delete", Text: strings.Join(a, "")}, {Op: "insert", Text: strings.Join(b, "")}}
+		if got := diffTokens(a, b); !reflect.DeepEqual(got, want) {
+			t.Errorf("diff of %d and %d lines has %d chunks, want a whole replacement", len(a), len(b), len(got))
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else if dp[i+1][j] > dp[i][j+1] {
+				dp[i][j] = dp[i+1][j]
+			} else {
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+	return dp[0][0]
+}
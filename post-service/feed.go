@@ -0,0 +1,95 @@
+// Following feed (feed.go)
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"blog-shared/auth"
+	"blog-shared/pagination"
+	"blog-shared/userclient"
+)
+
+// PostPage is one page of posts with the cursor for the next one
+type PostPage struct {
+	Posts      []Post `json:"posts"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// getFeed returns the newest published posts by the authors the caller
+// follows. Each followed author contributes at most one page of their own
+// newest posts through the posts (user_id, publish_at, id) index, so the cost
+// grows with the number of authors rather than with their whole history.
+// Authors the caller blocked stay followed but are left out.
+func getFeed(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	limit, err := pagination.Limit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var before *time.Time
+	var beforeID int
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		key, id, err := pagination.DecodeKeyCursor(cursor)
+		var t time.Time
+		if err == nil {
+			t, err = time.Parse(time.RFC3339Nano, key)
+		}
+		if err != nil {
+			http.Error(w, pagination.ErrInvalidCursor.Error(), http.StatusBadRequest)
+			return
+		}
+		before, beforeID = &t, id
+	}
+
+	rows, err := db.Query(
+		`SELECT p.id, p.user_id, p.title, p.content, p.language, p.category_id, p.status, p.publish_at, p.created_at, p.updated_at
+		FROM follows f
+		CROSS JOIN LATERAL (
+			SELECT `+postSelectColumns+`
+			FROM posts
+			WHERE user_id = f.followee_id AND status = 'published'
+				AND ($2::timestamptz IS NULL OR (publish_at, id) < ($2, $3))
+			ORDER BY publish_at DESC, id DESC
+			LIMIT $4
+		) p
+		WHERE f.follower_id = $1
+			AND NOT EXISTS (SELECT 1 FROM user_blocks b WHERE b.blocker_id = $1 AND b.blocked_id = f.followee_id)
+		ORDER BY p.publish_at DESC, p.id DESC
+		LIMIT $4`,
+		claims.UserID, before, beforeID, limit+1,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := PostPage{Posts: []Post{}}
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Posts = append(page.Posts, post)
+	}
+	// One extra row was fetched to tell whether there is another page
+	if len(page.Posts) > limit {
+		page.Posts = page.Posts[:limit]
+		last := page.Posts[limit-1]
+		page.NextCursor = pagination.EncodeKeyCursor(last.listedAt("publish_at").UTC().Format(time.RFC3339Nano), last.ID)
+	}
+	if err := attachTags(page.Posts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userService.Expand(r, len(page.Posts),
+		func(i int) *int { return page.Posts[i].UserID },
+		func(i int, author userclient.Author) { page.Posts[i].Author = &author })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+	"blog-shared/pagination"
+)
+
+func TestGetFeed(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+	now := time.Now().UTC()
+	// Posts take their place when published, not when written
+	written := now.Add(-24 * time.Hour)
+	fake := useFakeDB(t)
+	fake.OnQuery("FROM post_tags", tagColumns)
+	fake.OnQuery("FROM follows f", postColumns,
+		[]driver.Value{int64(9), int64(2), "Newest", "a", "english", nil, "published", now, written, now},
+		[]driver.Value{int64(7), int64(3), "Older", "b", "english", nil, "published", now.Add(-time.Hour), written, now},
+		[]driver.Value{int64(4), int64(2), "Oldest", "c", "english", nil, "published", now.Add(-2 * time.Hour), written, now},
+	)
+
+	req := httptest.NewRequest("GET", "/feed?limit=2", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, testClaims(1)))
+	rec := httptest.NewRecorder()
+	authn.RequireAuth(getFeed)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	var page PostPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Posts) != 2 || page.Posts[0].Title != "Newest" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	if !fake.Ran("b.blocker_id = $1 AND b.blocked_id = f.followee_id") {
+		t.Error("feed includes authors the caller blocked")
+	}
+	key, cursorID, err := pagination.DecodeKeyCursor(page.NextCursor)
+	cursorTime, _ := time.Parse(time.RFC3339Nano, key)
+	if err != nil || cursorID != 7 || !cursorTime.Equal(now.Add(-time.Hour)) {
+		t.Errorf("next cursor = %v, %d, %v; want the second post's position", cursorTime, cursorID, err)
+	}
+
+	req = httptest.NewRequest("GET", "/feed?cursor=not-a-cursor", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, testClaims(1)))
+	rec = httptest.NewRecorder()
+	authn.RequireAuth(getFeed)(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad cursor: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
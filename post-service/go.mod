@@ -4,8 +4,11 @@ module blog-service
 go 1.24
 
 require (
+	blog-shared v0.0.0
 	github.com/gorilla/mux v1.8.0
 	github.com/lib/pq v1.10.9
 )
 
 // go.sum will be generated when you run go mod download
+
+replace blog-shared => ../shared
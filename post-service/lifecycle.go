@@ -0,0 +1,177 @@
+// Post lifecycle and scheduled publishing (lifecycle.go)
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"blog-shared/auth"
+)
+
+// A post is only public while it is published. Scheduled posts are
+// published by runPublisher once their publish_at has passed.
+const (
+	statusDraft     = "draft"
+	statusScheduled = "scheduled"
+	statusPublished = "published"
+	statusArchived  = "archived"
+)
+
+// publishLockKey is the Postgres advisory lock that keeps replicas from
+// running the publisher at the same time
+const publishLockKey = 0x706f7374 // "post"
+
+var postStatuses = map[string]bool{
+	statusDraft: true, statusScheduled: true, statusPublished: true, statusArchived: true,
+}
+
+// applyPostStatus checks the status requested for a post and sets its
+// publish_at to match: the publishing time for scheduled posts, now for
+// posts published on the spot and nothing for the rest
+func applyPostStatus(post *Post) error {
+	switch post.Status {
+	case statusScheduled:
+		if post.PublishAt == nil || !post.PublishAt.After(time.Now()) {
+			return errors.New("Scheduled posts need a publish_at in the future")
+		}
+	case statusPublished:
+		now := time.Now()
+		post.PublishAt = &now
+	case statusDraft, statusArchived:
+		post.PublishAt = nil
+	default:
+		return errors.New("status must be draft, scheduled, published or archived")
+	}
+	return nil
+}
+
+// canSeePost reports whether the caller may read a post with the given
+// status and author. Posts that are not published are only shown to their
+// author and to editors.
+func canSeePost(r *http.Request, status string, ownerID *int) bool {
+	if status == statusPublished {
+		return true
+	}
+	claims, ok := auth.FromContext(r.Context())
+	if !ok {
+		return false
+	}
+	return claims.Can("posts:edit_any") || (ownerID != nil && *ownerID == claims.UserID)
+}
+
+// statusFilter returns the condition on posts p for a listing's ?status=,
+// which defaults to published. Other statuses list only the caller's own
+// posts, or everyone's for editors.
+func statusFilter(r *http.Request, arg func(interface{}) string) (string, int, error) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = statusPublished
+	}
+	if !postStatuses[status] {
+		return "", http.StatusBadRequest, errors.New("status must be draft, scheduled, published or archived")
+	}
+	condition := "p.status = " + arg(status)
+	if status == statusPublished {
+		return condition, 0, nil
+	}
+	claims, ok := auth.FromContext(r.Context())
+	if !ok {
+		return "", http.StatusUnauthorized, errors.New("Sign in to list unpublished posts")
+	}
+	if !claims.Can("posts:edit_any") {
+		condition += " AND p.user_id = " + arg(claims.UserID)
+	}
+	return condition, 0, nil
+}
+
+// listingTime returns the column that orders a listing with the request's
+// ?status= and that ?from=, ?to= and its cursors refer to. Published posts
+// take their place when they came out; the others have no such time and
+// take it when they were written.
+func listingTime(r *http.Request) string {
+	if status := r.URL.Query().Get("status"); status != "" && status != statusPublished {
+		return "created_at"
+	}
+	return "publish_at"
+}
+
+// listedAt returns a post's position in a listing ordered by column
+func (p Post) listedAt(column string) time.Time {
+	if column == "publish_at" && p.PublishAt != nil {
+		return *p.PublishAt
+	}
+	return p.CreatedAt
+}
+
+// runPublisher publishes due scheduled posts every PUBLISH_INTERVAL
+func runPublisher() {
+	ticker := time.NewTicker(envDuration("PUBLISH_INTERVAL", time.Minute))
+	defer ticker.Stop()
+	for range ticker.C {
+		ids, err := publishDuePosts()
+		if err != nil {
+			log.Printf("Error publishing scheduled posts: %v", err)
+		}
+		for _, id := range ids {
+			log.Printf("Published scheduled post %d", id)
+		}
+	}
+}
+
+// publishDuePosts publishes the scheduled posts whose publish_at has passed
+// and returns their ids. Every replica runs it, but only the one holding the
+// transaction-level advisory lock does any work, and a post only leaves the
+// scheduled state once, so each is published exactly once.
+func publishDuePosts() ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", publishLockKey).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(
+		`UPDATE posts SET status = 'published', updated_at = CURRENT_TIMESTAMP
+		WHERE status = 'scheduled' AND publish_at <= CURRENT_TIMESTAMP
+		RETURNING id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The lock is released with the transaction
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// envDuration reads a duration such as "30s" from the environment
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, fallback.String()))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+func TestApplyPostStatus(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name          string
+		post          Post
+		wantErr       bool
+		wantPublishAt bool
+	}{
+		{"draft", Post{Status: statusDraft, PublishAt: &future}, false, false},
+		{"scheduled", Post{Status: statusScheduled, PublishAt: &future}, false, true},
+		{"scheduled without time", Post{Status: statusScheduled}, true, false},
+		{"scheduled in the past", Post{Status: statusScheduled, PublishAt: &past}, true, false},
+		{"published", Post{Status: statusPublished}, false, true},
+		{"archived", Post{Status: statusArchived, PublishAt: &past}, false, false},
+		{"unknown", Post{Status: "hidden"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := applyPostStatus(&tt.post)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (tt.post.PublishAt != nil) != tt.wantPublishAt {
+				t.Errorf("publish_at = %v, want set %v", tt.post.PublishAt, tt.wantPublishAt)
+			}
+		})
+	}
+}
+
+func TestGetPostHidesUnpublished(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+	editor := testClaims(9)
+	editor.Permissions = []string{"posts:edit_any"}
+
+	tests := []struct {
+		name       string
+		status     string
+		claims     *auth.Claims
+		wantStatus int
+	}{
+		{"published to anyone", statusPublished, nil, http.StatusOK},
+		{"draft to anyone", statusDraft, nil, http.StatusNotFound},
+		{"draft to another user", statusDraft, ptr(testClaims(3)), http.StatusNotFound},
+		{"draft to its author", statusDraft, ptr(testClaims(2)), http.StatusOK},
+		{"scheduled to an editor", statusScheduled, &editor, http.StatusOK},
+		{"archived to anyone", statusArchived, nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			now := time.Now()
+			fake.OnQuery("FROM post_tags", tagColumns)
+			fake.OnQuery("FROM posts", postColumns,
+				[]driver.Value{int64(5), int64(2), "Title", "Body", "english", nil, tt.status, nil, now, now})
+
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/posts/5", nil), map[string]string{"id": "5"})
+			if tt.claims != nil {
+				req.Header.Set("Authorization", "Bearer "+signTestToken(t, *tt.claims))
+			}
+			rec := httptest.NewRecorder()
+			authn.OptionalAuth(getPost)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestStatusFilter(t *testing.T) {
+	editor := testClaims(9)
+	editor.Permissions = []string{"posts:edit_any"}
+
+	tests := []struct {
+		query         string
+		claims        *auth.Claims
+		wantCondition string
+		wantStatus    int
+	}{
+		{"", nil, "p.status = $1", 0},
+		{"status=draft", ptr(testClaims(2)), "p.status = $1 AND p.user_id = $2", 0},
+		{"status=scheduled", &editor, "p.status = $1", 0},
+		{"status=draft", nil, "", http.StatusUnauthorized},
+		{"status=deleted", ptr(testClaims(2)), "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/posts?"+tt.query, nil)
+			if tt.claims != nil {
+				req = req.WithContext(auth.NewContext(req.Context(), tt.claims))
+			}
+			var args []interface{}
+			condition, status, err := statusFilter(req, func(v interface{}) string {
+				args = append(args, v)
+				return "$" + strconv.Itoa(len(args))
+			})
+			if status != tt.wantStatus || (err != nil) != (tt.wantStatus != 0) {
+				t.Fatalf("status = %d, %v; want %d", status, err, tt.wantStatus)
+			}
+			if condition != tt.wantCondition {
+				t.Errorf("condition = %q, want %q", condition, tt.wantCondition)
+			}
+		})
+	}
+}
+
+func TestPublishDuePosts(t *testing.T) {
+	for _, locked := range []bool{true, false} {
+		t.Run("locked="+strconv.FormatBool(locked), func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("pg_try_advisory_xact_lock", []string{"locked"}, []driver.Value{locked})
+			fake.OnQuery("UPDATE posts SET status = 'published'", []string{"id"},
+				[]driver.Value{int64(3)}, []driver.Value{int64(8)})
+
+			ids, err := publishDuePosts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked && (len(ids) != 2 || ids[0] != 3 || ids[1] != 8) {
+				t.Errorf("published %v, want [3 8]", ids)
+			}
+			// Another replica holds the lock and does the work
+			if !locked && (len(ids) != 0 || fake.Ran("UPDATE posts")) {
+				t.Errorf("published %v without the lock", ids)
+			}
+		})
+	}
+}
+
+func TestCreateScheduledPost(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+	author := testClaims(4)
+	author.EmailVerified = true
+	author.Permissions = []string{"posts:write"}
+
+	fake := useFakeDB(t)
+	fake.OnExec("INSERT INTO post_revisions", 1)
+	now := time.Now()
+	fake.OnQuery("INSERT INTO posts", []string{"id", "created_at", "updated_at"}, []driver.Value{int64(10), now, now})
+
+	publishAt := now.Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	body := `{"title":"T","content":"C","status":"scheduled","publish_at":"` + publishAt + `"}`
+	req := httptest.NewRequest("POST", "/posts", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, author))
+	rec := httptest.NewRecorder()
+	authn.RequireAuth(createPost)(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"status":"scheduled"`) || !strings.Contains(rec.Body.String(), publishAt) {
+		t.Errorf("unexpected post %s", rec.Body.String())
+	}
+}
+
+func TestUpdatePostPublishNeedsVerifiedEmail(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+	verified := testClaims(4)
+	verified.EmailVerified = true
+	unverified := testClaims(4)
+
+	tests := []struct {
+		name       string
+		claims     auth.Claims
+		status     string
+		wantStatus int
+	}{
+		{"verified author publishes", verified, statusPublished, http.StatusOK},
+		{"unverified author publishes", unverified, statusPublished, http.StatusForbidden},
+		{"unverified author schedules", unverified, statusScheduled, http.StatusForbidden},
+		{"unverified author edits a draft", unverified, statusDraft, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			now := time.Now()
+			fake.OnQuery("SELECT user_id FROM posts", []string{"user_id"}, []driver.Value{int64(4)})
+			fake.OnExec("INSERT INTO post_revisions", 1)
+			fake.OnExec("UPDATE posts", 1)
+			fake.OnQuery("FROM post_tags", tagColumns)
+			fake.OnQuery("FROM posts", postColumns,
+				[]driver.Value{int64(5), int64(4), "T", "C", "english", nil, tt.status, nil, now, now})
+
+			body := `{"title":"T","content":"C","status":"` + tt.status + `"`
+			if tt.status == statusScheduled {
+				body += `,"publish_at":"` + now.Add(time.Hour).UTC().Format(time.RFC3339) + `"`
+			}
+			req := httptest.NewRequest("PUT", "/posts/5", strings.NewReader(body+"}"))
+			req = mux.SetURLVars(req, map[string]string{"id": "5"})
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, tt.claims))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(updatePost)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if fake.Ran("UPDATE posts") != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("post updated = %v", fake.Ran("UPDATE posts"))
+			}
+		})
+	}
+}
+
+func TestListingTime(t *testing.T) {
+	published, written := time.Now(), time.Now().Add(-time.Hour)
+	post := Post{Status: statusPublished, PublishAt: &published, CreatedAt: written}
+
+	for query, want := range map[string]string{"": "publish_at", "status=published": "publish_at", "status=draft": "created_at"} {
+		column := listingTime(httptest.NewRequest("GET", "/posts?"+query, nil))
+		if column != want {
+			t.Errorf("%q: column = %s, want %s", query, column, want)
+		}
+	}
+	if !post.listedAt("publish_at").Equal(published) || !post.listedAt("created_at").Equal(written) {
+		t.Errorf("listedAt = %v, %v", post.listedAt("publish_at"), post.listedAt("created_at"))
+	}
+}
@@ -0,0 +1,176 @@
+// Post listing and filters (list.go)
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"blog-shared/pagination"
+	"blog-shared/userclient"
+)
+
+// getPosts lists posts newest first, a page at a time. ?after= takes the
+// next_cursor of the previous page, which is also sent as a Link header.
+// ?author=, ?tag=, ?category=, ?from= and ?to= narrow the listing, and
+// ?expand=author embeds each post's author. Only published posts are listed,
+// by publishing time, unless ?status= asks for the caller's drafts,
+// scheduled or archived posts.
+func getPosts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := pagination.Limit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	visible, status, err := statusFilter(r, arg)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	column := listingTime(r)
+	conditions, err := postFilters(query, column, arg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conditions = append([]string{visible}, conditions...)
+	if after := query.Get("after"); after != "" {
+		key, id, err := pagination.DecodeKeyCursor(after)
+		var t time.Time
+		if err == nil {
+			t, err = time.Parse(time.RFC3339Nano, key)
+		}
+		if err != nil {
+			http.Error(w, pagination.ErrInvalidCursor.Error(), http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, fmt.Sprintf("(p.%s, p.id) < (%s, %s)", column, arg(t), arg(id)))
+	}
+	where := "WHERE " + strings.Join(conditions, " AND ")
+
+	// The (publish_at, id) index of published posts and the (user_id,
+	// publish_at, id) index serve this from any position, so deep pages cost
+	// the same as the first
+	rows, err := db.Query(
+		`SELECT `+postSelectColumns+`
+		FROM posts p
+		`+where+`
+		ORDER BY p.`+column+` DESC, p.id DESC
+		LIMIT `+arg(limit+1),
+		args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := PostPage{Posts: []Post{}}
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Posts = append(page.Posts, post)
+	}
+	// One extra row was fetched to tell whether there is another page
+	if len(page.Posts) > limit {
+		page.Posts = page.Posts[:limit]
+		last := page.Posts[limit-1]
+		page.NextCursor = pagination.EncodeKeyCursor(last.listedAt(column).UTC().Format(time.RFC3339Nano), last.ID)
+		setNextLink(w, r, "after", page.NextCursor)
+	}
+	if err := attachTags(page.Posts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userService.Expand(r, len(page.Posts),
+		func(i int) *int { return page.Posts[i].UserID },
+		func(i int, author userclient.Author) { page.Posts[i].Author = &author })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// postFilters turns the filter parameters of a listing into conditions on
+// posts p, adding their values with arg. ?from= and ?to= bound the given
+// time column.
+func postFilters(query url.Values, column string, arg func(interface{}) string) ([]string, error) {
+	var conditions []string
+	if raw := query.Get("author"); raw != "" {
+		author, err := strconv.Atoi(raw)
+		if err != nil || author < 1 {
+			return nil, errors.New("author must be a user id")
+		}
+		conditions = append(conditions, "p.user_id = "+arg(author))
+	}
+	if raw := query.Get("tag"); raw != "" {
+		tag, err := normalizeTag(raw)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+			WHERE pt.post_id = p.id AND t.name = `+arg(tag)+`)`)
+	}
+	// A category includes the posts of its subcategories
+	if raw := query.Get("category"); raw != "" {
+		category, err := strconv.Atoi(raw)
+		if err != nil || category < 1 {
+			return nil, errors.New("category must be a category id")
+		}
+		conditions = append(conditions, "p.category_id IN ("+fmt.Sprintf(categorySubtree, arg(category))+")")
+	}
+	if raw := query.Get("from"); raw != "" {
+		from, _, err := parseDateParam(raw)
+		if err != nil {
+			return nil, fmt.Errorf("from %v", err)
+		}
+		conditions = append(conditions, "p."+column+" >= "+arg(from))
+	}
+	if raw := query.Get("to"); raw != "" {
+		to, dateOnly, err := parseDateParam(raw)
+		if err != nil {
+			return nil, fmt.Errorf("to %v", err)
+		}
+		// A date includes the whole of that day
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		conditions = append(conditions, "p."+column+" < "+arg(to))
+	}
+	return conditions, nil
+}
+
+// parseDateParam accepts an RFC 3339 timestamp or a YYYY-MM-DD date, which
+// is taken as midnight UTC
+func parseDateParam(raw string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, false, errors.New("must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+	}
+	return t, false, nil
+}
+
+// setNextLink points a Link header at the next page, keeping the other
+// query parameters of the request
+func setNextLink(w http.ResponseWriter, r *http.Request, param, cursor string) {
+	query := r.URL.Query()
+	query.Set(param, cursor)
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, query.Encode()))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/pagination"
+)
+
+func TestGetPostsPagination(t *testing.T) {
+	now := time.Now().UTC()
+	// Posts take their place when published, not when written
+	written := now.Add(-24 * time.Hour)
+	fake := useFakeDB(t)
+	fake.OnQuery("FROM post_tags", tagColumns)
+	fake.OnQuery("FROM posts p", postColumns,
+		[]driver.Value{int64(9), int64(2), "Newest", "a", "english", nil, "published", now, written, now},
+		[]driver.Value{int64(7), int64(3), "Older", "b", "english", nil, "published", now.Add(-time.Hour), written, now},
+		[]driver.Value{int64(4), int64(2), "Oldest", "c", "english", nil, "published", now.Add(-2 * time.Hour), written, now},
+	)
+
+	rec := httptest.NewRecorder()
+	getPosts(rec, httptest.NewRequest("GET", "/posts?limit=2&author=2", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	var page PostPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Posts) != 2 || page.Posts[1].Title != "Older" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	key, cursorID, err := pagination.DecodeKeyCursor(page.NextCursor)
+	cursorTime, _ := time.Parse(time.RFC3339Nano, key)
+	if err != nil || cursorID != 7 || !cursorTime.Equal(now.Add(-time.Hour)) {
+		t.Errorf("next cursor = %v, %d, %v; want the second post's position", cursorTime, cursorID, err)
+	}
+	wantLink := `</posts?after=` + page.NextCursor + `&author=2&limit=2>; rel="next"`
+	if link := rec.Header().Get("Link"); link != wantLink {
+		t.Errorf("Link = %q, want %q", link, wantLink)
+	}
+
+	// The last page has no cursor
+	rec = httptest.NewRecorder()
+	getPosts(rec, httptest.NewRequest("GET", "/posts?limit=3&after="+page.NextCursor, nil))
+	if strings.Contains(rec.Body.String(), "next_cursor") || rec.Header().Get("Link") != "" {
+		t.Errorf("last page links onward: %s", rec.Body.String())
+	}
+	if !fake.Ran("(p.publish_at, p.id) < ($2, $3)") {
+		t.Error("cursor was not applied")
+	}
+
+	for _, query := range []string{"after=not-a-cursor", "limit=0", "author=me", "from=yesterday"} {
+		rec := httptest.NewRecorder()
+		getPosts(rec, httptest.NewRequest("GET", "/posts?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPostFilters(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		query          string
+		wantConditions []string
+		wantArgs       []interface{}
+	}{
+		{"", nil, nil},
+		{"author=5", []string{"p.user_id = $1"}, []interface{}{5}},
+		{"tag=Web%20Dev", []string{`EXISTS (SELECT 1 FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+			WHERE pt.post_id = p.id AND t.name = $1)`}, []interface{}{"web-dev"}},
+		{"from=2024-03-01&to=2024-03-01", []string{"p.publish_at >= $1", "p.publish_at < $2"}, []interface{}{day, day.AddDate(0, 0, 1)}},
+		{"to=2024-03-01T12:00:00Z", []string{"p.publish_at < $1"}, []interface{}{day.Add(12 * time.Hour)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			var args []interface{}
+			conditions, err := postFilters(query, "publish_at", func(v interface{}) string {
+				args = append(args, v)
+				return "$" + strconv.Itoa(len(args))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(conditions, " AND ") != strings.Join(tt.wantConditions, " AND ") {
+				t.Errorf("conditions = %q, want %q", conditions, tt.wantConditions)
+			}
+			if len(args) != len(tt.wantArgs) {
+				t.Fatalf("args = %v, want %v", args, tt.wantArgs)
+			}
+			for i := range args {
+				if want, ok := tt.wantArgs[i].(time.Time); ok {
+					if !args[i].(time.Time).Equal(want) {
+						t.Errorf("arg %d = %v, want %v", i, args[i], want)
+					}
+				} else if args[i] != tt.wantArgs[i] {
+					t.Errorf("arg %d = %v, want %v", i, args[i], tt.wantArgs[i])
+				}
+			}
+		})
+	}
+}
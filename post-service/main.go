@@ -8,24 +8,46 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"blog-shared/auth"
+	"blog-shared/userclient"
+
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
+// postSelectColumns selects everything scanPost reads
+const postSelectColumns = "id, user_id, title, content, language, category_id, status, publish_at, created_at, updated_at"
+
 // Post represents a blog post
 type Post struct {
 	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
+	UserID    *int      `json:"user_id"` // nil once the author's account is anonymized
 	Title     string    `json:"title"`
 	Content   string    `json:"content"`
+	Language  string    `json:"language"` // text search configuration, see search.go
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// Tags are loaded separately by attachTags, see tags.go
+	Tags       []string `json:"tags"`
+	CategoryID *int     `json:"category_id"`
+
+	// Status is draft, scheduled, published or archived, see lifecycle.go
+	Status    string     `json:"status"`
+	PublishAt *time.Time `json:"publish_at"`
+
+	// Author is only filled in for ?expand=author
+	Author *userclient.Author `json:"author,omitempty"`
 }
 
 var db *sql.DB
 
+// userService looks up authors for ?expand=author
+var userService *userclient.Client
+
 func main() {
 	// Set up database connection using environment variables
 	dbUser := getEnv("DB_USER", "postgres")
@@ -38,6 +60,13 @@ func main() {
 		dbUser, dbPassword, dbHost, dbPort, dbName)
 
 	var err error
+	verifier, err = auth.LoadVerifier()
+	if err != nil {
+		log.Fatal(err)
+	}
+	authn.VerifiedEmailRequired = getEnv("REQUIRE_VERIFIED_EMAIL", "true") == "true"
+	userService = userclient.New(getEnv("USER_SERVICE_URL", "http://localhost:8081"), time.Minute)
+
 	db, err = sql.Open("postgres", connectionString)
 	if err != nil {
 		log.Fatal(err)
@@ -60,11 +89,26 @@ func main() {
 	})
 
 	r.HandleFunc("/health", healthCheck).Methods("GET")
-	r.HandleFunc("/posts", createPost).Methods("POST")
-	r.HandleFunc("/posts", getPosts).Methods("GET")
-	r.HandleFunc("/posts/{id:[0-9]+}", getPost).Methods("GET")
-	r.HandleFunc("/posts/{id:[0-9]+}", updatePost).Methods("PUT")
-	r.HandleFunc("/posts/{id:[0-9]+}", deletePost).Methods("DELETE")
+	r.HandleFunc("/posts", authn.RequireAuth(authn.RequireVerifiedEmail(auth.RequirePermission("posts:write", createPost)))).Methods("POST")
+	r.HandleFunc("/posts", authn.OptionalAuth(getPosts)).Methods("GET")
+	r.HandleFunc("/posts/search", searchPosts).Methods("GET")
+	r.HandleFunc("/tags", getTags).Methods("GET")
+	r.HandleFunc("/tags/merge", authn.RequireAuth(auth.RequirePermission("taxonomy:manage", mergeTags))).Methods("POST")
+	r.HandleFunc("/tags/{name}", authn.RequireAuth(auth.RequirePermission("taxonomy:manage", deleteTag))).Methods("DELETE")
+	r.HandleFunc("/categories", getCategories).Methods("GET")
+	r.HandleFunc("/categories", authn.RequireAuth(auth.RequirePermission("taxonomy:manage", createCategory))).Methods("POST")
+	r.HandleFunc("/categories/{id:[0-9]+}", authn.RequireAuth(auth.RequirePermission("taxonomy:manage", updateCategory))).Methods("PUT")
+	r.HandleFunc("/categories/{id:[0-9]+}", authn.RequireAuth(auth.RequirePermission("taxonomy:manage", deleteCategory))).Methods("DELETE")
+	r.HandleFunc("/feed", authn.RequireAuth(getFeed)).Methods("GET")
+	r.HandleFunc("/posts/{id:[0-9]+}", authn.OptionalAuth(getPost)).Methods("GET")
+	r.HandleFunc("/posts/{id:[0-9]+}", authn.RequireAuth(updatePost)).Methods("PUT")
+	r.HandleFunc("/posts/{id:[0-9]+}", authn.RequireAuth(deletePost)).Methods("DELETE")
+	r.HandleFunc("/posts/{id:[0-9]+}/revisions", authn.RequireAuth(getRevisions)).Methods("GET")
+	r.HandleFunc("/posts/{id:[0-9]+}/revisions/diff", authn.RequireAuth(diffRevisions)).Methods("GET")
+	r.HandleFunc("/posts/{id:[0-9]+}/revisions/{rev:[0-9]+}", authn.RequireAuth(getRevision)).Methods("GET")
+	r.HandleFunc("/posts/{id:[0-9]+}/revisions/{rev:[0-9]+}/restore", authn.RequireAuth(restoreRevision)).Methods("POST")
+
+	go runPublisher()
 
 	// Start server
 	port := getEnv("PORT", "8082")
@@ -116,61 +160,89 @@ func createPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The author is always the authenticated caller, never the request body
+	claims, _ := auth.FromContext(r.Context())
+	post.UserID = &claims.UserID
+
 	// Simple validation
-	if post.Title == "" || post.Content == "" || post.UserID == 0 {
-		http.Error(w, "Title, content, and user_id are required", http.StatusBadRequest)
+	if post.Title == "" || post.Content == "" {
+		http.Error(w, "Title and content are required", http.StatusBadRequest)
+		return
+	}
+	if err := validateLanguage(&post.Language); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if post.Language == "" {
+		post.Language = defaultLanguage
+	}
+	tags, err := normalizeTags(post.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	post.Tags = tags
+	if post.Status == "" {
+		post.Status = statusPublished
+	}
+	if post.Status == statusArchived {
+		http.Error(w, "New posts cannot be archived", http.StatusBadRequest)
+		return
+	}
+	if err := applyPostStatus(&post); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Insert the new post
-	err := db.QueryRow(
-		"INSERT INTO posts (user_id, title, content) VALUES ($1, $2, $3) RETURNING id, created_at, updated_at",
-		post.UserID, post.Title, post.Content,
-	).Scan(&post.ID, &post.CreatedAt, &post.UpdatedAt)
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, "Error creating post: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(post)
-}
+	if post.CategoryID != nil && !checkPostCategory(w, tx, *post.CategoryID) {
+		return
+	}
 
-// getPosts returns all blog posts, with optional pagination
-func getPosts(w http.ResponseWriter, r *http.Request) {
-	// In a real app, you'd implement pagination here
-	rows, err := db.Query("SELECT id, user_id, title, content, created_at, updated_at FROM posts ORDER BY created_at DESC LIMIT 100")
+	// Insert the new post
+	err = tx.QueryRow(
+		`INSERT INTO posts (user_id, title, content, language, category_id, status, publish_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, updated_at`,
+		post.UserID, post.Title, post.Content, post.Language, post.CategoryID, post.Status, post.PublishAt,
+	).Scan(&post.ID, &post.CreatedAt, &post.UpdatedAt)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error creating post: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	posts := []Post{}
-	for rows.Next() {
-		var post Post
-		if err := rows.Scan(&post.ID, &post.UserID, &post.Title, &post.Content, &post.CreatedAt, &post.UpdatedAt); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if len(post.Tags) > 0 {
+		if err := setPostTags(tx, post.ID, post.Tags); err != nil {
+			http.Error(w, "Error tagging post: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		posts = append(posts, post)
+	}
+	if err := recordRevision(tx, post.ID, post.UserID); err != nil {
+		http.Error(w, "Error creating post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error creating post: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(post)
 }
 
-// getPost returns a specific blog post by ID
+// getPost returns a specific blog post by ID. Unpublished posts look
+// missing to everyone but their author and editors.
 func getPost(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var post Post
-	err := db.QueryRow(
-		"SELECT id, user_id, title, content, created_at, updated_at FROM posts WHERE id = $1",
-		id,
-	).Scan(&post.ID, &post.UserID, &post.Title, &post.Content, &post.CreatedAt, &post.UpdatedAt)
+	post, err := scanPost(db.QueryRow("SELECT "+postSelectColumns+" FROM posts WHERE id = $1", id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Post not found", http.StatusNotFound)
@@ -179,6 +251,16 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !canSeePost(r, post.Status, post.UserID) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	posts := []Post{post}
+	if err := attachTags(posts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	post = posts[0]
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(post)
@@ -200,26 +282,99 @@ func updatePost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Title and content are required", http.StatusBadRequest)
 		return
 	}
+	if err := validateLanguage(&post.Language); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if post.Tags != nil {
+		tags, err := normalizeTags(post.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		post.Tags = tags
+	}
+	if post.Status != "" {
+		if err := applyPostStatus(&post); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Only the author or an editor may change a post
+	if !authorizePostOwner(w, r, id, "posts:edit_any") {
+		return
+	}
+	// Publishing a draft needs a verified address, as creating a post does
+	if (post.Status == statusPublished || post.Status == statusScheduled) && !authn.CheckVerifiedEmail(w, r) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error updating post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// category_id 0 removes the post from its category
+	if post.CategoryID != nil && *post.CategoryID != 0 && !checkPostCategory(w, tx, *post.CategoryID) {
+		return
+	}
 
-	// Update the post
-	_, err := db.Exec(
-		"UPDATE posts SET title = $1, content = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
-		post.Title, post.Content, id,
+	// Posts written before revisions were kept get their first one now
+	postID, _ := strconv.Atoi(id)
+	if err := recordRevision(tx, postID, nil); err != nil {
+		http.Error(w, "Error updating post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Update the post. Language, tags, category and status are kept unless
+	// given, and a post that was already out keeps its original publish_at
+	// when it is archived or published again.
+	_, err = tx.Exec(
+		`UPDATE posts SET title = $1, content = $2, language = COALESCE(NULLIF($3, '')::regconfig, language),
+			category_id = CASE WHEN $4::integer IS NULL THEN category_id ELSE NULLIF($4, 0) END,
+			publish_at = CASE
+				WHEN $5 = '' THEN publish_at
+				WHEN $5 IN ('published', 'archived') AND status IN ('published', 'archived') THEN publish_at
+				ELSE $6::timestamptz END,
+			status = COALESCE(NULLIF($5, ''), status),
+			updated_at = CURRENT_TIMESTAMP WHERE id = $7`,
+		post.Title, post.Content, post.Language, post.CategoryID, post.Status, post.PublishAt, id,
 	)
 	if err != nil {
 		http.Error(w, "Error updating post: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if post.Tags != nil {
+		if err := setPostTags(tx, postID, post.Tags); err != nil {
+			http.Error(w, "Error tagging post: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	claims, _ := auth.FromContext(r.Context())
+	if err := recordRevision(tx, postID, &claims.UserID); err != nil {
+		http.Error(w, "Error updating post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error updating post: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Get the updated post
-	err = db.QueryRow(
-		"SELECT id, user_id, title, content, created_at, updated_at FROM posts WHERE id = $1",
-		id,
-	).Scan(&post.ID, &post.UserID, &post.Title, &post.Content, &post.CreatedAt, &post.UpdatedAt)
+	post, err = scanPost(db.QueryRow("SELECT "+postSelectColumns+" FROM posts WHERE id = $1", id))
 	if err != nil {
 		http.Error(w, "Post not found after update", http.StatusInternalServerError)
 		return
 	}
+	posts := []Post{post}
+	if err := attachTags(posts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	post = posts[0]
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(post)
@@ -230,6 +385,11 @@ func deletePost(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	// Only the author or an editor may delete a post
+	if !authorizePostOwner(w, r, id, "posts:delete_any") {
+		return
+	}
+
 	// Delete the post
 	result, err := db.Exec("DELETE FROM posts WHERE id = $1", id)
 	if err != nil {
@@ -251,3 +411,37 @@ func deletePost(w http.ResponseWriter, r *http.Request) {
 	// Return a success message
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// authorizePostOwner looks up the author of a post and writes a 404 or 403
+// response unless the caller is the author or holds anyPermission
+func authorizePostOwner(w http.ResponseWriter, r *http.Request, id, anyPermission string) bool {
+	var ownerID sql.NullInt64
+	err := db.QueryRow("SELECT user_id FROM posts WHERE id = $1", id).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	claims, _ := auth.FromContext(r.Context())
+	if !auth.CanModify(claims, int(ownerID.Int64), "posts:write", anyPermission) {
+		http.Error(w, "You do not have permission to modify this post", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPost reads a row selected with postSelectColumns
+func scanPost(row rowScanner) (Post, error) {
+	var p Post
+	err := row.Scan(&p.ID, &p.UserID, &p.Title, &p.Content, &p.Language, &p.CategoryID, &p.Status, &p.PublishAt, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
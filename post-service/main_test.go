@@ -1,7 +1,202 @@
 package main
 
-import "testing"
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+	"blog-shared/fakedb"
+	"blog-shared/userclient"
+
+	"github.com/gorilla/mux"
+)
 
 func TestHealthCheck(t *testing.T) {
-	_ = 2
+	rec := httptest.NewRecorder()
+	healthCheck(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// useFakeDB points db at a scripted fake for the duration of the test
+func useFakeDB(t *testing.T) *fakedb.DB {
+	t.Helper()
+	return fakedb.Use(t, &db)
+}
+
+var postColumns = []string{"id", "user_id", "title", "content", "language", "category_id", "status", "publish_at", "created_at", "updated_at"}
+
+var tagColumns = []string{"post_id", "name"}
+
+func TestPostOwnershipAuthorization(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+	editor := testClaims(9)
+	editor.Permissions = []string{"posts:write", "posts:edit_any", "posts:delete_any"}
+	moderator := testClaims(8)
+	moderator.Permissions = []string{"comments:write", "comments:moderate"}
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		claims     *auth.Claims
+		ownerID    int64
+		missing    bool
+		wantStatus int
+		wantWrite  string
+	}{
+		{"update without token", updatePost, "PUT", nil, 1, false, http.StatusUnauthorized, ""},
+		{"update by owner", updatePost, "PUT", ptr(testClaims(1)), 1, false, http.StatusOK, "UPDATE posts"},
+		{"update by other user", updatePost, "PUT", ptr(testClaims(2)), 1, false, http.StatusForbidden, ""},
+		{"update by editor", updatePost, "PUT", &editor, 1, false, http.StatusOK, "UPDATE posts"},
+		{"update by comment moderator", updatePost, "PUT", &moderator, 1, false, http.StatusForbidden, ""},
+		{"update missing post", updatePost, "PUT", ptr(testClaims(1)), 0, true, http.StatusNotFound, ""},
+		{"delete without token", deletePost, "DELETE", nil, 1, false, http.StatusUnauthorized, ""},
+		{"delete by owner", deletePost, "DELETE", ptr(testClaims(1)), 1, false, http.StatusNoContent, "DELETE FROM posts"},
+		{"delete by other user", deletePost, "DELETE", ptr(testClaims(2)), 1, false, http.StatusForbidden, ""},
+		{"delete by editor", deletePost, "DELETE", &editor, 1, false, http.StatusNoContent, "DELETE FROM posts"},
+		{"delete by comment moderator", deletePost, "DELETE", &moderator, 1, false, http.StatusForbidden, ""},
+		{"delete missing post", deletePost, "DELETE", ptr(testClaims(1)), 0, true, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("INSERT INTO post_revisions", 1)
+			if !tt.missing {
+				fake.OnQuery("SELECT user_id FROM posts", []string{"user_id"}, []driver.Value{tt.ownerID})
+			} else {
+				fake.OnQuery("SELECT user_id FROM posts", []string{"user_id"})
+			}
+			fake.OnExec("UPDATE posts", 1)
+			fake.OnExec("DELETE FROM posts", 1)
+			now := time.Now()
+			fake.OnQuery("SELECT id, user_id", postColumns, []driver.Value{int64(5), tt.ownerID, "Title", "Body", "english", nil, "published", nil, now, now})
+			fake.OnQuery("FROM post_tags", tagColumns)
+
+			req := httptest.NewRequest(tt.method, "/posts/5", strings.NewReader(`{"title":"Title","content":"Body"}`))
+			req = mux.SetURLVars(req, map[string]string{"id": "5"})
+			if tt.claims != nil {
+				req.Header.Set("Authorization", "Bearer "+signTestToken(t, *tt.claims))
+			}
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(tt.handler)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			for _, write := range []string{"UPDATE posts", "DELETE FROM posts"} {
+				if ran := fake.Ran(write); ran != (write == tt.wantWrite) {
+					t.Errorf("ran %q = %v, want %v", write, ran, !ran)
+				}
+			}
+		})
+	}
+}
+
+func ptr(c auth.Claims) *auth.Claims { return &c }
+
+func TestCreatePostPermission(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+	reader := testClaims(3)
+	reader.EmailVerified = true
+	reader.Permissions = []string{"comments:write"}
+	author := testClaims(4)
+	author.EmailVerified = true
+	author.Permissions = []string{"posts:write", "comments:write"}
+
+	tests := []struct {
+		name       string
+		claims     auth.Claims
+		wantStatus int
+	}{
+		{"reader", reader, http.StatusForbidden},
+		{"author", author, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("INSERT INTO post_revisions", 1)
+			now := time.Now()
+			fake.OnQuery("INSERT INTO posts", []string{"id", "created_at", "updated_at"}, []driver.Value{int64(10), now, now})
+
+			// user_id in the body must be ignored in favour of the token
+			req := httptest.NewRequest("POST", "/posts", strings.NewReader(`{"title":"T","content":"C","user_id":1}`))
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, tt.claims))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(auth.RequirePermission("posts:write", createPost))(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusCreated && !strings.Contains(rec.Body.String(), `"user_id":4`) {
+				t.Errorf("post not attributed to token user: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetPostsAnonymizedAuthor(t *testing.T) {
+	fake := useFakeDB(t)
+	now := time.Now()
+	fake.OnQuery("FROM post_tags", tagColumns)
+	fake.OnQuery("FROM posts", postColumns,
+		[]driver.Value{int64(1), int64(7), "Kept", "by author", "english", nil, "published", nil, now, now},
+		[]driver.Value{int64(2), nil, "Orphaned", "author deleted", "english", nil, "published", nil, now, now})
+
+	rec := httptest.NewRecorder()
+	getPosts(rec, httptest.NewRequest("GET", "/posts", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `"user_id":7`) || !strings.Contains(body, `"user_id":null`) {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestGetPostsExpandAuthor(t *testing.T) {
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ids") != "7" {
+			t.Errorf("ids = %q, want 7", r.URL.Query().Get("ids"))
+		}
+		w.Write([]byte(`{"users":[{"id":7,"username":"alice","avatar_url":"https://cdn.example.com/a.jpg"}]}`))
+	}))
+	defer users.Close()
+	userService = userclient.New(users.URL, 0)
+
+	fake := useFakeDB(t)
+	now := time.Now()
+	fake.OnQuery("FROM post_tags", tagColumns)
+	fake.OnQuery("FROM posts", postColumns,
+		[]driver.Value{int64(1), int64(7), "Kept", "by author", "english", nil, "published", nil, now, now},
+		[]driver.Value{int64(2), nil, "Orphaned", "author deleted", "english", nil, "published", nil, now, now})
+
+	for _, tt := range []struct {
+		query      string
+		wantAuthor bool
+	}{
+		{"", false},
+		{"?expand=author", true},
+	} {
+		rec := httptest.NewRecorder()
+		getPosts(rec, httptest.NewRequest("GET", "/posts"+tt.query, nil))
+
+		body := rec.Body.String()
+		if got := strings.Contains(body, `"author":{"id":7,"username":"alice","avatar":"https://cdn.example.com/a.jpg"}`); got != tt.wantAuthor {
+			t.Errorf("%q: author embedded = %v, want %v: %s", tt.query, got, tt.wantAuthor, body)
+		}
+		if strings.Count(body, `"author"`) > 1 {
+			t.Errorf("%q: anonymized post has an author: %s", tt.query, body)
+		}
+	}
 }
@@ -0,0 +1,243 @@
+// Post revision history (revisions.go)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+// Revision is a saved version of a post's title and content. Content is
+// left out of revision listings.
+type Revision struct {
+	Revision  int       `json:"revision"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content,omitempty"`
+	EditorID  *int      `json:"editor_id"` // nil once the editor's account is deleted
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RevisionDiff shows what changed between two revisions
+type RevisionDiff struct {
+	From    int         `json:"from"`
+	To      int         `json:"to"`
+	Mode    string      `json:"mode"`
+	Title   []DiffChunk `json:"title"`
+	Content []DiffChunk `json:"content"`
+}
+
+// recordRevision saves a post's current title and content as its next
+// revision unless they match the latest one. The editor defaults to the
+// post's author, which is right for the first revision of a post written
+// before history was kept. Callers hold the post's row lock or are about to
+// take it, so revision numbers only clash for such first revisions, where
+// the loser has nothing to add.
+func recordRevision(tx *sql.Tx, postID int, editorID *int) error {
+	_, err := tx.Exec(
+		`INSERT INTO post_revisions (post_id, revision, title, content, editor_id, created_at)
+		SELECT p.id, COALESCE(latest.revision, 0) + 1, p.title, p.content, COALESCE($2, p.user_id), p.updated_at
+		FROM posts p
+		LEFT JOIN LATERAL (
+			SELECT revision, title, content FROM post_revisions
+			WHERE post_id = p.id ORDER BY revision DESC LIMIT 1
+		) latest ON TRUE
+		WHERE p.id = $1 AND (latest.revision IS NULL OR latest.title <> p.title OR latest.content <> p.content)
+		ON CONFLICT (post_id, revision) DO NOTHING`,
+		postID, editorID,
+	)
+	return err
+}
+
+// getRevisions lists the revisions of a post, newest first
+func getRevisions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authorizePostOwner(w, r, id, "posts:edit_any") {
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT revision, title, editor_id, created_at FROM post_revisions
+		WHERE post_id = $1 ORDER BY revision DESC`,
+		id,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		if err := rows.Scan(&rev.Revision, &rev.Title, &rev.EditorID, &rev.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		revisions = append(revisions, rev)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// getRevision returns one revision of a post with its content
+func getRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorizePostOwner(w, r, vars["id"], "posts:edit_any") {
+		return
+	}
+
+	rev, err := loadRevision(vars["id"], vars["rev"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rev)
+}
+
+// diffRevisions compares revision ?from= with revision ?to= of a post, line
+// by line or, with ?mode=word, word by word. Titles are always compared
+// word by word.
+func diffRevisions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	from, errFrom := strconv.Atoi(query.Get("from"))
+	to, errTo := strconv.Atoi(query.Get("to"))
+	if errFrom != nil || errTo != nil {
+		http.Error(w, "from and to must be revision numbers", http.StatusBadRequest)
+		return
+	}
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "line"
+	}
+	split := splitLines
+	switch mode {
+	case "line":
+	case "word":
+		split = splitWords
+	default:
+		http.Error(w, "mode must be line or word", http.StatusBadRequest)
+		return
+	}
+	if !authorizePostOwner(w, r, id, "posts:edit_any") {
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT revision, title, content FROM post_revisions WHERE post_id = $1 AND revision IN ($2, $3)",
+		id, from, to,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	revisions := map[int]Revision{}
+	for rows.Next() {
+		var rev Revision
+		if err := rows.Scan(&rev.Revision, &rev.Title, &rev.Content); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		revisions[rev.Revision] = rev
+	}
+	old, okFrom := revisions[from]
+	current, okTo := revisions[to]
+	if !okFrom || !okTo {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RevisionDiff{
+		From:    from,
+		To:      to,
+		Mode:    mode,
+		Title:   diffTokens(splitWords(old.Title), splitWords(current.Title)),
+		Content: diffTokens(split(old.Content), split(current.Content)),
+	})
+}
+
+// restoreRevision puts an old revision's title and content back. The
+// restored text becomes the newest revision, so nothing is lost.
+func restoreRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	postID, _ := strconv.Atoi(id)
+	if !authorizePostOwner(w, r, id, "posts:edit_any") {
+		return
+	}
+	claims, _ := auth.FromContext(r.Context())
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error restoring revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := recordRevision(tx, postID, nil); err != nil {
+		http.Error(w, "Error restoring revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result, err := tx.Exec(
+		`UPDATE posts SET title = r.title, content = r.content, updated_at = CURRENT_TIMESTAMP
+		FROM post_revisions r
+		WHERE posts.id = $1 AND r.post_id = posts.id AND r.revision = $2`,
+		id, vars["rev"],
+	)
+	if err != nil {
+		http.Error(w, "Error restoring revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if err := recordRevision(tx, postID, &claims.UserID); err != nil {
+		http.Error(w, "Error restoring revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error restoring revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	post, err := scanPost(db.QueryRow("SELECT "+postSelectColumns+" FROM posts WHERE id = $1", id))
+	if err != nil {
+		http.Error(w, "Post not found after restore", http.StatusInternalServerError)
+		return
+	}
+	posts := []Post{post}
+	if err := attachTags(posts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(posts[0])
+}
+
+// loadRevision reads one revision of a post
+func loadRevision(postID, revision string) (Revision, error) {
+	var rev Revision
+	err := db.QueryRow(
+		`SELECT revision, title, content, editor_id, created_at FROM post_revisions
+		WHERE post_id = $1 AND revision = $2`,
+		postID, revision,
+	).Scan(&rev.Revision, &rev.Title, &rev.Content, &rev.EditorID, &rev.CreatedAt)
+	return rev, err
+}
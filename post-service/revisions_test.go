@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDiffRevisions(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		wantContent []DiffChunk
+	}{
+		{"lines", "from=1&to=2", http.StatusOK, []DiffChunk{
+			{"equal", "first line\n"},
+			{"delete", "second line\n"},
+			{"insert", "second line, edited\n"},
+			{"equal", "third line\n"},
+		}},
+		{"words", "from=1&to=2&mode=word", http.StatusOK, []DiffChunk{
+			{"equal", "first line\nsecond "},
+			{"delete", "line"},
+			{"insert", "line, edited"},
+			{"equal", "\nthird line\n"},
+		}},
+		{"missing revision", "from=1&to=7", http.StatusNotFound, nil},
+		{"bad mode", "from=1&to=2&mode=char", http.StatusBadRequest, nil},
+		{"no revisions", "from=1", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT user_id FROM posts", []string{"user_id"}, []driver.Value{int64(2)})
+			fake.OnQuery("FROM post_revisions", []string{"revision", "title", "content"},
+				[]driver.Value{int64(1), "Draft title", "first line\nsecond line\nthird line\n"},
+				[]driver.Value{int64(2), "Final title", "first line\nsecond line, edited\nthird line\n"},
+			)
+
+			req := httptest.NewRequest("GET", "/posts/5/revisions/diff?"+tt.query, nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "5"})
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, testClaims(2)))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(diffRevisions)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var diff RevisionDiff
+			if err := json.NewDecoder(rec.Body).Decode(&diff); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(diff.Content, tt.wantContent) {
+				t.Errorf("content diff = %q, want %q", diff.Content, tt.wantContent)
+			}
+			wantTitle := []DiffChunk{{"delete", "Draft"}, {"insert", "Final"}, {"equal", " title"}}
+			if !reflect.DeepEqual(diff.Title, wantTitle) {
+				t.Errorf("title diff = %q, want %q", diff.Title, wantTitle)
+			}
+		})
+	}
+}
+
+func TestRevisionsOnlyForAuthorAndEditors(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+	editor := testClaims(9)
+	editor.Permissions = []string{"posts:edit_any"}
+
+	tests := []struct {
+		name       string
+		claims     auth.Claims
+		wantStatus int
+	}{
+		{"author", testClaims(2), http.StatusOK},
+		{"editor", editor, http.StatusOK},
+		{"someone else", testClaims(3), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT user_id FROM posts", []string{"user_id"}, []driver.Value{int64(2)})
+			fake.OnQuery("FROM post_revisions", []string{"revision", "title", "editor_id", "created_at"},
+				[]driver.Value{int64(2), "Final title", int64(9), time.Now()},
+				[]driver.Value{int64(1), "Draft title", int64(2), time.Now()},
+			)
+
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/posts/5/revisions", nil), map[string]string{"id": "5"})
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, tt.claims))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(getRevisions)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var revisions []Revision
+			if err := json.NewDecoder(rec.Body).Decode(&revisions); err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != 2 || revisions[0].Revision != 2 || revisions[0].Content != "" {
+				t.Errorf("revisions = %+v", revisions)
+			}
+		})
+	}
+}
+
+func TestRestoreRevision(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+	for _, found := range []bool{true, false} {
+		fake := useFakeDB(t)
+		fake.OnQuery("SELECT user_id FROM posts", []string{"user_id"}, []driver.Value{int64(2)})
+		fake.OnExec("INSERT INTO post_revisions", 1)
+		if found {
+			fake.OnExec("UPDATE posts SET title = r.title", 1)
+		} else {
+			fake.OnExec("UPDATE posts SET title = r.title", 0)
+		}
+		now := time.Now()
+		fake.OnQuery("FROM post_tags", tagColumns)
+		fake.OnQuery("SELECT id, user_id", postColumns,
+			[]driver.Value{int64(5), int64(2), "Draft title", "Body", "english", nil, "published", now, now, now})
+
+		req := httptest.NewRequest("POST", "/posts/5/revisions/1/restore", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "5", "rev": "1"})
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, testClaims(2)))
+		rec := httptest.NewRecorder()
+		authn.RequireAuth(restoreRevision)(rec, req)
+
+		wantStatus := http.StatusOK
+		if !found {
+			wantStatus = http.StatusNotFound
+		}
+		if rec.Code != wantStatus {
+			t.Fatalf("found=%v: status = %d, want %d (%s)", found, rec.Code, wantStatus, rec.Body.String())
+		}
+		if found && !fake.Ran("INSERT INTO post_revisions") {
+			t.Error("restore did not record a revision")
+		}
+	}
+}
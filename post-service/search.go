@@ -0,0 +1,233 @@
+// Full-text search over posts (search.go)
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"blog-shared/pagination"
+	"blog-shared/userclient"
+)
+
+const (
+	defaultLanguage = "english"
+	maxQueryLength  = 200
+
+	// ts_headline marks matches with these; they are swapped for <mark>
+	// tags once the rest of the text has been HTML-escaped
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// searchLanguages are the Postgres text search configurations a post can be
+// written in. They decide how words are stemmed and which are stop words.
+var searchLanguages = map[string]bool{
+	"simple": true, "arabic": true, "danish": true, "dutch": true, "english": true,
+	"finnish": true, "french": true, "german": true, "greek": true, "hungarian": true,
+	"indonesian": true, "irish": true, "italian": true, "lithuanian": true, "nepali": true,
+	"norwegian": true, "portuguese": true, "romanian": true, "russian": true, "spanish": true,
+	"swedish": true, "tamil": true, "turkish": true,
+}
+
+// SearchResult is a post matching a search. Highlight is the title and
+// Snippet the best fragments of the content, both HTML-escaped with the
+// matching words wrapped in <mark>.
+type SearchResult struct {
+	Post
+	Highlight string  `json:"highlight"`
+	Snippet   string  `json:"snippet"`
+	Rank      float32 `json:"rank"`
+}
+
+// SearchPage is one page of search results, best matches first
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// searchPosts handles GET /posts/search?q=. Words must all appear, in any
+// form the post's language stems to the same word; "quoted words" must
+// appear together in that order, and word* matches any word starting with
+// word. Posts in ?language= (english by default) are searched, ranked with
+// title matches above content matches.
+func searchPosts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(q) > maxQueryLength {
+		http.Error(w, fmt.Sprintf("q must be at most %d characters", maxQueryLength), http.StatusBadRequest)
+		return
+	}
+	tsquery := buildTSQuery(q)
+	if tsquery == "" {
+		http.Error(w, "q must contain at least one word", http.StatusBadRequest)
+		return
+	}
+	language := query.Get("language")
+	if err := validateLanguage(&language); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if language == "" {
+		language = defaultLanguage
+	}
+	limit, err := pagination.Limit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args := []interface{}{language, tsquery}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	after := "TRUE"
+	if cursor := query.Get("after"); cursor != "" {
+		key, id, err := pagination.DecodeKeyCursor(cursor)
+		if err == nil {
+			_, err = strconv.ParseFloat(key, 32)
+		}
+		if err != nil {
+			http.Error(w, pagination.ErrInvalidCursor.Error(), http.StatusBadRequest)
+			return
+		}
+		after = fmt.Sprintf("(rank, id) < (%s::real, %s)", arg(key), arg(id))
+	}
+
+	// The GIN index finds the matches; only the page that is returned pays
+	// for ts_headline
+	options := `StartSel="` + highlightStart + `", StopSel="` + highlightStop + `"`
+	rows, err := db.Query(
+		`SELECT `+postSelectColumns+`, rank,
+			ts_headline(language, title, query, 'HighlightAll=true, `+options+`'),
+			ts_headline(language, content, query, 'MaxFragments=2, MaxWords=30, MinWords=10, `+options+`')
+		FROM (
+			SELECT p.*, q.query, ts_rank(p.search_vector, q.query) AS rank
+			FROM posts p, to_tsquery($1::regconfig, $2) q(query)
+			WHERE p.language = $1::regconfig AND p.status = 'published' AND p.search_vector @@ q.query
+		) matches
+		WHERE `+after+`
+		ORDER BY rank DESC, id DESC
+		LIMIT `+arg(limit+1),
+		args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := SearchPage{Results: []SearchResult{}}
+	for rows.Next() {
+		var result SearchResult
+		p := &result.Post
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Title, &p.Content, &p.Language, &p.CategoryID, &p.Status, &p.PublishAt, &p.CreatedAt, &p.UpdatedAt,
+			&result.Rank, &result.Highlight, &result.Snippet); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Highlight = markHighlights(result.Highlight)
+		result.Snippet = markHighlights(result.Snippet)
+		page.Results = append(page.Results, result)
+	}
+	// One extra row was fetched to tell whether there is another page
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		last := page.Results[limit-1]
+		page.NextCursor = pagination.EncodeKeyCursor(strconv.FormatFloat(float64(last.Rank), 'g', -1, 32), last.ID)
+		setNextLink(w, r, "after", page.NextCursor)
+	}
+
+	posts := make([]Post, len(page.Results))
+	for i := range page.Results {
+		posts[i] = page.Results[i].Post
+	}
+	if err := attachTags(posts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userService.Expand(r, len(posts),
+		func(i int) *int { return posts[i].UserID },
+		func(i int, author userclient.Author) { posts[i].Author = &author })
+	for i := range page.Results {
+		page.Results[i].Post = posts[i]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// validateLanguage normalizes and checks a post or search language. An
+// empty language is left for the caller to default.
+func validateLanguage(language *string) error {
+	*language = strings.ToLower(strings.TrimSpace(*language))
+	if *language != "" && !searchLanguages[*language] {
+		return fmt.Errorf("%q is not a supported language", *language)
+	}
+	return nil
+}
+
+// buildTSQuery turns a search box query into to_tsquery syntax. Words are
+// ANDed, "quoted words" become a phrase and a trailing * makes a prefix
+// match. Everything but letters and digits is dropped, so user input can
+// never form tsquery operators of its own.
+func buildTSQuery(q string) string {
+	var terms []string
+	for i, part := range strings.Split(q, `"`) {
+		words := queryWords(part)
+		if len(words) == 0 {
+			continue
+		}
+		// Odd parts are inside quotes
+		if i%2 == 1 && len(words) > 1 {
+			terms = append(terms, "("+strings.Join(words, " <-> ")+")")
+		} else {
+			terms = append(terms, words...)
+		}
+	}
+	return strings.Join(terms, " & ")
+}
+
+// queryWords splits text into words of letters and digits, marking words
+// followed by * as prefixes
+func queryWords(text string) []string {
+	var words []string
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+		word := string(runes[start:i])
+		if i < len(runes) && runes[i] == '*' {
+			word += ":*"
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// markHighlights escapes ts_headline output for HTML and turns its match
+// markers into <mark> tags
+func markHighlights(s string) string {
+	s = html.EscapeString(s)
+	return strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>").Replace(s)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"blog-shared/pagination"
+)
+
+func TestBuildTSQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"go generics", "go & generics"},
+		{`"error handling" in go`, "(error <-> handling) & in & go"},
+		{"postgr* tuning", "postgr:* & tuning"},
+		{`"context cancel*"`, "(context <-> cancel:*)"},
+		{`"single"`, "single"},
+		{"naïve café 42", "naïve & café & 42"},
+		{`a & b | !c <-> 'd':*`, "a & b & c & d"},
+		{"*** !!!", ""},
+	}
+	for _, tt := range tests {
+		if got := buildTSQuery(tt.q); got != tt.want {
+			t.Errorf("buildTSQuery(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestMarkHighlights(t *testing.T) {
+	got := markHighlights("<b>" + highlightStart + "Go" + highlightStop + "</b> & more")
+	if want := "&lt;b&gt;<mark>Go</mark>&lt;/b&gt; &amp; more"; got != want {
+		t.Errorf("markHighlights = %q, want %q", got, want)
+	}
+}
+
+func TestSearchPosts(t *testing.T) {
+	now := time.Now().UTC()
+	columns := append(append([]string{}, postColumns...), "rank", "highlight", "snippet")
+	fake := useFakeDB(t)
+	fake.OnQuery("FROM post_tags", tagColumns)
+	fake.OnQuery("to_tsquery", columns,
+		[]driver.Value{int64(3), int64(1), "Go tips", "a", "english", nil, "published", nil, now, now, 0.9, highlightStart + "Go" + highlightStop + " tips", "..."},
+		[]driver.Value{int64(8), int64(2), "Other", "b", "english", nil, "published", nil, now, now, 0.25, "Other", "about " + highlightStart + "go" + highlightStop},
+		[]driver.Value{int64(5), int64(2), "Third", "c", "english", nil, "published", nil, now, now, 0.1, "Third", "..."},
+	)
+
+	rec := httptest.NewRecorder()
+	searchPosts(rec, httptest.NewRequest("GET", "/posts/search?q=go&limit=2", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	var page SearchPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Results) != 2 || page.Results[0].Highlight != "<mark>Go</mark> tips" || page.Results[1].Snippet != "about <mark>go</mark>" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	rank, id, err := pagination.DecodeKeyCursor(page.NextCursor)
+	if err != nil || id != 8 || rank != "0.25" {
+		t.Errorf("next cursor = %v, %d, %v; want the second result's position", rank, id, err)
+	}
+
+	for _, query := range []string{"", "q=%22%22", "q=go&language=klingon", "q=go&after=not-a-cursor"} {
+		rec := httptest.NewRecorder()
+		searchPosts(rec, httptest.NewRequest("GET", "/posts/search?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Post tags (tags.go)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"blog-shared/pagination"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxTagLength   = 50
+	maxTagsPerPost = 10
+)
+
+// TagCount is a tag with the number of posts carrying it
+type TagCount struct {
+	Name      string `json:"name"`
+	PostCount int    `json:"post_count"`
+}
+
+// MergeTagsRequest moves every post tagged with one of From to Into
+type MergeTagsRequest struct {
+	From []string `json:"from"`
+	Into string   `json:"into"`
+}
+
+// normalizeTag turns user input into a tag name: lower case, words joined
+// by hyphens, letters and digits only. "Web  Dev" and "web_dev" both become
+// "web-dev".
+func normalizeTag(raw string) (string, error) {
+	tag := slugify(raw)
+	if tag == "" {
+		return "", fmt.Errorf("%q is not a valid tag", raw)
+	}
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		return "", fmt.Errorf("Tags must be at most %d characters", maxTagLength)
+	}
+	return tag, nil
+}
+
+// slugify lower-cases s, keeps its letters and digits and joins the words
+// with single hyphens
+func slugify(s string) string {
+	var b strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if pendingHyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingHyphen = false
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '-' || r == '_':
+			pendingHyphen = true
+		}
+	}
+	return b.String()
+}
+
+// normalizeTags normalizes a post's tags, dropping duplicates
+func normalizeTags(raw []string) ([]string, error) {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, r := range raw {
+		tag, err := normalizeTag(r)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTagsPerPost {
+		return nil, fmt.Errorf("A post can have at most %d tags", maxTagsPerPost)
+	}
+	return tags, nil
+}
+
+// setPostTags replaces the tags of a post, creating tags that do not exist yet
+func setPostTags(tx *sql.Tx, postID int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE post_id = $1", postID); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING",
+		pq.Array(tags),
+	); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		"INSERT INTO post_tags (post_id, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2)",
+		postID, pq.Array(tags),
+	)
+	return err
+}
+
+// attachTags loads the tags of a page of posts with one query
+func attachTags(posts []Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(posts))
+	index := make(map[int]int, len(posts))
+	for i := range posts {
+		ids[i] = int64(posts[i].ID)
+		index[posts[i].ID] = i
+		posts[i].Tags = []string{}
+	}
+
+	rows, err := db.Query(
+		`SELECT pt.post_id, t.name FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id = ANY($1) ORDER BY t.name`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var postID int
+		var name string
+		if err := rows.Scan(&postID, &name); err != nil {
+			return err
+		}
+		if i, ok := index[postID]; ok {
+			posts[i].Tags = append(posts[i].Tags, name)
+		}
+	}
+	return rows.Err()
+}
+
+// getTags lists tags with how many published posts use them, most used first.
+// ?q= keeps only tags starting with the given text.
+func getTags(w http.ResponseWriter, r *http.Request) {
+	limit, err := pagination.Limit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix := ""
+	if q := r.URL.Query().Get("q"); q != "" {
+		if prefix, err = normalizeTag(q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := db.Query(
+		`SELECT t.name, COUNT(p.id) AS post_count
+		FROM tags t
+		LEFT JOIN post_tags pt ON pt.tag_id = t.id
+		LEFT JOIN posts p ON p.id = pt.post_id AND p.status = 'published'
+		WHERE t.name LIKE $1
+		GROUP BY t.id
+		ORDER BY post_count DESC, t.name
+		LIMIT $2`,
+		escapeLike(prefix)+"%", limit,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.PostCount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tags = append(tags, tag)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// mergeTags retags every post carrying one of the From tags with Into and
+// deletes the From tags. Into is created if needed, so merging a single tag
+// renames it.
+func mergeTags(w http.ResponseWriter, r *http.Request) {
+	var req MergeTagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	into, err := normalizeTag(req.Into)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Tags are looked up as stored, so tags saved before a change to the
+	// normalization rules can still be merged away
+	var from []string
+	for _, name := range req.From {
+		if name = strings.TrimSpace(name); name != "" && name != into {
+			from = append(from, name)
+		}
+	}
+	if len(from) == 0 {
+		http.Error(w, "from must name at least one tag other than into", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var intoID int
+	err = tx.QueryRow(
+		`INSERT INTO tags (name) VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id`,
+		into,
+	).Scan(&intoID)
+	if err != nil {
+		http.Error(w, "Error merging tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO post_tags (post_id, tag_id)
+		SELECT pt.post_id, $1 FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE t.name = ANY($2)
+		ON CONFLICT DO NOTHING`,
+		intoID, pq.Array(from),
+	); err != nil {
+		http.Error(w, "Error merging tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// post_tags rows of the old tags go with them
+	result, err := tx.Exec("DELETE FROM tags WHERE name = ANY($1)", pq.Array(from))
+	if err != nil {
+		http.Error(w, "Error merging tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error merging tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteTag removes a tag from every post
+func deleteTag(w http.ResponseWriter, r *http.Request) {
+	result, err := db.Exec("DELETE FROM tags WHERE name = $1", mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Error deleting tag: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
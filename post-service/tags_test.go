@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"Go", "go", false},
+		{"  Web  Dev ", "web-dev", false},
+		{"web_dev", "web-dev", false},
+		{"--c++--", "c", false},
+		{"Café", "café", false},
+		{"!!!", "", true},
+		{strings.Repeat("a", maxTagLength+1), "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTag(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeTag(%q) = %q, %v; want %q, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	got, err := normalizeTags([]string{"Go", "go", "Web Dev", "web-dev"})
+	if err != nil || !reflect.DeepEqual(got, []string{"go", "web-dev"}) {
+		t.Errorf("normalizeTags = %q, %v", got, err)
+	}
+	if got, err := normalizeTags(nil); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("normalizeTags(nil) = %#v, %v; want an empty list", got, err)
+	}
+
+	tooMany := make([]string, maxTagsPerPost+1)
+	for i := range tooMany {
+		tooMany[i] = "tag" + string(rune('a'+i))
+	}
+	if _, err := normalizeTags(tooMany); err == nil {
+		t.Error("more than the maximum number of tags accepted")
+	}
+}
+
+func TestAttachTags(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnQuery("FROM post_tags", tagColumns,
+		[]driver.Value{int64(2), "go"},
+		[]driver.Value{int64(2), "web-dev"},
+		[]driver.Value{int64(1), "go"},
+	)
+
+	posts := []Post{{ID: 1}, {ID: 2}, {ID: 3}}
+	if err := attachTags(posts); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"go"}, {"go", "web-dev"}, {}}
+	for i, p := range posts {
+		if !reflect.DeepEqual(p.Tags, want[i]) {
+			t.Errorf("post %d tags = %#v, want %#v", p.ID, p.Tags, want[i])
+		}
+	}
+}
+
+func TestGetTags(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnQuery("FROM tags t", []string{"name", "post_count"},
+		[]driver.Value{"go", int64(12)},
+		[]driver.Value{"golang", int64(1)},
+	)
+
+	rec := httptest.NewRecorder()
+	getTags(rec, httptest.NewRequest("GET", "/tags?q=Go&limit=5", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	var tags []TagCount
+	if err := json.NewDecoder(rec.Body).Decode(&tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0] != (TagCount{"go", 12}) {
+		t.Errorf("tags = %+v", tags)
+	}
+	if escapeLike("50%_off") != `50\%\_off` {
+		t.Errorf("escapeLike = %q", escapeLike("50%_off"))
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		deleted    int64
+		wantStatus int
+	}{
+		{"merge", `{"from":["golang","go-lang"],"into":"Go"}`, 2, http.StatusNoContent},
+		{"rename", `{"from":["js"],"into":"javascript"}`, 1, http.StatusNoContent},
+		{"unknown tags", `{"from":["nope"],"into":"go"}`, 0, http.StatusNotFound},
+		{"into itself", `{"from":["go"],"into":"Go"}`, 0, http.StatusBadRequest},
+		{"invalid target", `{"from":["go"],"into":"???"}`, 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("INSERT INTO tags", []string{"id"}, []driver.Value{int64(1)})
+			fake.OnExec("INSERT INTO post_tags", 3)
+			fake.OnExec("DELETE FROM tags", tt.deleted)
+
+			rec := httptest.NewRecorder()
+			mergeTags(rec, httptest.NewRequest("POST", "/tags/merge", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusBadRequest && !fake.Ran("ON CONFLICT DO NOTHING") {
+				t.Error("posts were not retagged")
+			}
+		})
+	}
+}
+
+func TestCreatePostWithTags(t *testing.T) {
+	verifier = &auth.Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+	author := testClaims(4)
+	author.EmailVerified = true
+	author.Permissions = []string{"posts:write"}
+
+	tests := []struct {
+		name           string
+		body           string
+		categoryExists bool
+		wantStatus     int
+		wantTags       []string
+	}{
+		{"tags", `{"title":"T","content":"C","tags":["Go","web dev","go"]}`, false, http.StatusCreated, []string{"go", "web-dev"}},
+		{"category", `{"title":"T","content":"C","category_id":3}`, true, http.StatusCreated, []string{}},
+		{"unknown category", `{"title":"T","content":"C","category_id":9}`, false, http.StatusBadRequest, nil},
+		{"invalid tag", `{"title":"T","content":"C","tags":["?"]}`, false, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("INSERT INTO post_revisions", 1)
+			fake.OnQuery("FROM categories", []string{"exists"}, []driver.Value{tt.categoryExists})
+			fake.OnQuery("INSERT INTO posts", []string{"id", "created_at", "updated_at"}, []driver.Value{int64(10), time.Now(), time.Now()})
+			fake.OnExec("post_tags", 2)
+			fake.OnExec("INSERT INTO tags", 2)
+
+			req := httptest.NewRequest("POST", "/posts", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, author))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(auth.RequirePermission("posts:write", createPost))(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusCreated {
+				if fake.Ran("INSERT INTO posts") {
+					t.Error("invalid post was inserted")
+				}
+				return
+			}
+			var post Post
+			if err := json.NewDecoder(rec.Body).Decode(&post); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(post.Tags, tt.wantTags) {
+				t.Errorf("tags = %#v, want %#v", post.Tags, tt.wantTags)
+			}
+			if ran := fake.Ran("INSERT INTO post_tags"); ran != (len(tt.wantTags) > 0) {
+				t.Errorf("tagged = %v", ran)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"blog-shared/fakedb"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+var testVerifier = &Verifier{Algorithm: "HS256", HMACKey: []byte(testSecret), Issuer: "blog-user-service"}
+
+// testAuthenticator returns an Authenticator like the post and comment
+// services use, backed by a scripted database
+func testAuthenticator(t *testing.T) (*Authenticator, *fakedb.DB) {
+	var db *sql.DB
+	fake := fakedb.Use(t, &db)
+	return &Authenticator{
+		Parse:                 testVerifier.Parse,
+		DB:                    func() *sql.DB { return db },
+		PersonalTokens:        true,
+		VerifiedEmailRequired: true,
+	}, fake
+}
+
+// signTestToken builds an HS256 token the way user-service does
+func signTestToken(t *testing.T, claims Claims) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func testClaims(userID int) Claims {
+	return Claims{
+		Subject:   strconv.Itoa(userID),
+		Issuer:    "blog-user-service",
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		UserID:    userID,
+		Username:  "user" + strconv.Itoa(userID),
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	expired := testClaims(7)
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+	}{
+		{"missing header", "", http.StatusUnauthorized},
+		{"wrong scheme", "Basic abc", http.StatusUnauthorized},
+		{"garbage token", "Bearer abc.def.ghi", http.StatusUnauthorized},
+		{"expired token", "Bearer " + signTestToken(t, expired), http.StatusUnauthorized},
+		{"valid token", "Bearer " + signTestToken(t, testClaims(7)), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authn, _ := testAuthenticator(t)
+			var gotUserID int
+			handler := authn.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+				claims, _ := FromContext(r.Context())
+				gotUserID = claims.UserID
+			})
+
+			req := httptest.NewRequest("POST", "/posts", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && gotUserID != 7 {
+				t.Errorf("user id = %d, want 7", gotUserID)
+			}
+		})
+	}
+}
+
+func TestParseRejectsOtherAlgorithms(t *testing.T) {
+	rs256 := &Verifier{Algorithm: "RS256", Issuer: "blog-user-service"}
+	if _, err := rs256.Parse(signTestToken(t, testClaims(7))); err != ErrInvalidToken {
+		t.Errorf("HS256 token accepted by an RS256 verifier: %v", err)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	verified := testClaims(1)
+	verified.EmailVerified = true
+	unverified := testClaims(2)
+
+	tests := []struct {
+		name       string
+		required   bool
+		claims     Claims
+		wantStatus int
+	}{
+		{"verified, policy on", true, verified, http.StatusOK},
+		{"unverified, policy on", true, unverified, http.StatusForbidden},
+		{"unverified, policy off", false, unverified, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authn, _ := testAuthenticator(t)
+			authn.VerifiedEmailRequired = tt.required
+			handler := authn.RequireAuth(authn.RequireVerifiedEmail(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest("POST", "/posts", nil)
+			req.Header.Set("Authorization", "Bearer "+signTestToken(t, tt.claims))
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequireAuthRejectsRevokedSession(t *testing.T) {
+	for _, active := range []bool{true, false} {
+		authn, fake := testAuthenticator(t)
+		fake.OnQuery("FROM sessions", []string{"active"}, []driver.Value{active})
+
+		claims := testClaims(7)
+		claims.SessionID = 5
+		req := httptest.NewRequest("POST", "/posts", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, claims))
+		rec := httptest.NewRecorder()
+		authn.RequireAuth(func(w http.ResponseWriter, r *http.Request) {})(rec, req)
+
+		want := http.StatusOK
+		if !active {
+			want = http.StatusUnauthorized
+		}
+		if rec.Code != want {
+			t.Errorf("session active=%v: status = %d, want %d", active, rec.Code, want)
+		}
+	}
+}
+
+func TestRequireAuthPersonalToken(t *testing.T) {
+	columns := []string{"id", "user_id", "username", "email_verified", "perms"}
+
+	tests := []struct {
+		name       string
+		accepted   bool
+		row        []driver.Value
+		wantStatus int
+	}{
+		{"active token", true, []driver.Value{int64(3), int64(7), "alice", true, "{posts:write}"}, http.StatusOK},
+		{"unknown, expired or revoked token", true, nil, http.StatusUnauthorized},
+		{"not accepted by the service", false, []driver.Value{int64(3), int64(7), "alice", true, "{posts:write}"}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authn, fake := testAuthenticator(t)
+			authn.PersonalTokens = tt.accepted
+			if tt.row != nil {
+				fake.OnQuery("FROM personal_access_tokens", columns, tt.row)
+			} else {
+				fake.OnQuery("FROM personal_access_tokens", columns)
+			}
+			fake.OnExec("UPDATE personal_access_tokens", 1)
+
+			var got *Claims
+			req := httptest.NewRequest("POST", "/posts", nil)
+			req.Header.Set("Authorization", "Bearer blog_pat_abc")
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = FromContext(r.Context())
+			})(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if got.UserID != 7 || got.PersonalTokenID != 3 || !got.Can("posts:write") {
+					t.Errorf("unexpected claims %+v", got)
+				}
+				if !fake.Ran("last_used_at") {
+					t.Error("last use was not recorded")
+				}
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	editor := testClaims(7)
+	editor.Permissions = []string{"posts:write", "posts:edit_any"}
+
+	for _, tt := range []struct {
+		claims     Claims
+		wantStatus int
+	}{
+		{editor, http.StatusOK},
+		{testClaims(8), http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("POST", "/tags/merge", nil)
+		req = req.WithContext(NewContext(req.Context(), &tt.claims))
+		rec := httptest.NewRecorder()
+		RequirePermission("posts:edit_any", func(w http.ResponseWriter, r *http.Request) {})(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("permissions %v: status = %d, want %d", tt.claims.Permissions, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestCanModify(t *testing.T) {
+	session := testClaims(7)
+	scoped := testClaims(7)
+	scoped.PersonalTokenID = 3
+	scoped.Permissions = []string{"posts:write"}
+	unscoped := testClaims(7)
+	unscoped.PersonalTokenID = 4
+	unscoped.Permissions = []string{"comments:moderate"}
+
+	tests := []struct {
+		name   string
+		claims Claims
+		owner  int
+		want   bool
+	}{
+		{"session owner", session, 7, true},
+		{"session non-owner", session, 8, false},
+		{"token owner with scope", scoped, 7, true},
+		{"token owner without scope", unscoped, 7, false},
+	}
+
+	for _, tt := range tests {
+		if got := CanModify(&tt.claims, tt.owner, "posts:write", "posts:edit_any"); got != tt.want {
+			t.Errorf("%s: CanModify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
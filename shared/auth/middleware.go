@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Authenticator checks the bearer token of incoming requests
+type Authenticator struct {
+	// Parse verifies a JWT access token, usually Verifier.Parse
+	Parse func(token string) (*Claims, error)
+
+	// DB returns the database holding sessions and personal access tokens
+	DB func() *sql.DB
+
+	// PersonalTokens accepts personal access tokens besides JWTs
+	PersonalTokens bool
+
+	// VerifiedEmailRequired makes RequireVerifiedEmail block unverified
+	// accounts, set from REQUIRE_VERIFIED_EMAIL
+	VerifiedEmailRequired bool
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// NewContext returns a copy of ctx carrying the caller's claims
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// FromContext returns the claims stored by RequireAuth
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// RequireAuth rejects requests without a valid bearer token and stores the
+// verified claims in the request context
+func (a *Authenticator) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="blog"`)
+			http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		token := strings.TrimPrefix(header, "Bearer ")
+		if a.PersonalTokens && strings.HasPrefix(token, PersonalTokenPrefix) {
+			claims, err := a.personalTokenClaims(token)
+			if err != nil && err != ErrInvalidToken {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err == ErrInvalidToken {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="blog", error="invalid_token"`)
+				http.Error(w, "Invalid, expired or revoked token", http.StatusUnauthorized)
+				return
+			}
+			next(w, r.WithContext(NewContext(r.Context(), claims)))
+			return
+		}
+
+		claims, err := a.Parse(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="blog", error="invalid_token"`)
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		// Tokens die with their session, e.g. after a password change
+		if claims.SessionID != 0 {
+			active, err := a.sessionActive(claims.SessionID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !active {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="blog", error="invalid_token"`)
+				http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		next(w, r.WithContext(NewContext(r.Context(), claims)))
+	}
+}
+
+// OptionalAuth authenticates requests that carry a bearer token, like
+// RequireAuth, and passes anonymous requests through without claims
+func (a *Authenticator) OptionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	authenticated := a.RequireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+		authenticated(w, r)
+	}
+}
+
+// RequireVerifiedEmail rejects callers who have not verified their email
+// address when VerifiedEmailRequired is set. It must be wrapped by
+// RequireAuth.
+func (a *Authenticator) RequireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.CheckVerifiedEmail(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// CheckVerifiedEmail is RequireVerifiedEmail for handlers that need a
+// verified address only for some requests. It answers 403 and returns false
+// when the caller lacks one.
+func (a *Authenticator) CheckVerifiedEmail(w http.ResponseWriter, r *http.Request) bool {
+	claims, _ := FromContext(r.Context())
+	if a.VerifiedEmailRequired && !claims.EmailVerified {
+		http.Error(w, "Please verify your email address first", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// RequirePermission rejects authenticated requests whose claims lack the
+// given permission. It must be wrapped by RequireAuth.
+func RequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := FromContext(r.Context())
+		if !claims.Can(permission) {
+			http.Error(w, "Missing permission: "+permission, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// CanModify reports whether the caller may change a resource owned by
+// ownerID, either as its owner or by holding anyPermission. Personal access
+// tokens act as the owner only when they carry ownPermission.
+func CanModify(claims *Claims, ownerID int, ownPermission, anyPermission string) bool {
+	if claims.Can(anyPermission) {
+		return true
+	}
+	return claims.UserID == ownerID && (claims.PersonalTokenID == 0 || claims.Can(ownPermission))
+}
+
+// sessionActive reports whether the login session a token was issued for is
+// still live
+func (a *Authenticator) sessionActive(sessionID int) (bool, error) {
+	var active bool
+	err := a.DB().QueryRow(
+		"SELECT revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP FROM sessions WHERE id = $1",
+		sessionID,
+	).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+// personalTokenClaims looks up a personal access token and builds claims for
+// its owner. The token's permissions are its scopes narrowed to what the
+// owner's roles still grant.
+func (a *Authenticator) personalTokenClaims(token string) (*Claims, error) {
+	db := a.DB()
+	sum := sha256.Sum256([]byte(token))
+	var claims Claims
+	err := db.QueryRow(
+		`SELECT t.id, u.id, u.username, u.email_verified_at IS NOT NULL,
+			COALESCE(array_agg(DISTINCT p.name) FILTER (WHERE p.name IS NOT NULL), '{}')
+		FROM personal_access_tokens t
+		JOIN users u ON u.id = t.user_id
+		LEFT JOIN user_roles ur ON ur.user_id = u.id
+		LEFT JOIN role_permissions rp ON rp.role_id = ur.role_id
+		LEFT JOIN permissions p ON p.id = rp.permission_id AND p.name = ANY(t.scopes)
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL AND t.expires_at > CURRENT_TIMESTAMP
+		GROUP BY t.id, u.id`,
+		hex.EncodeToString(sum[:]),
+	).Scan(&claims.PersonalTokenID, &claims.UserID, &claims.Username, &claims.EmailVerified, pq.Array(&claims.Permissions))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	claims.Subject = strconv.Itoa(claims.UserID)
+
+	// Only record use about once a minute to keep hot tokens from writing on every request
+	_, err = db.Exec(
+		`UPDATE personal_access_tokens SET last_used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')`,
+		claims.PersonalTokenID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
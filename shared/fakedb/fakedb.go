@@ -0,0 +1,156 @@
+// Package fakedb is a scripted database/sql driver for handler tests
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// DB answers each query with the first registered response whose match
+// string it contains
+type DB struct {
+	mu        sync.Mutex
+	responses []*response
+	executed  []statement
+}
+
+// statement is a query the code under test ran, with its arguments
+type statement struct {
+	query string
+	args  []driver.Value
+}
+
+type response struct {
+	match        string
+	columns      []string
+	rows         [][]driver.Value
+	rowsAffected int64
+	err          error
+}
+
+// Use points *db at a new DB for the duration of the test
+func Use(t *testing.T, db **sql.DB) *DB {
+	t.Helper()
+	f := &DB{}
+	previous := *db
+	*db = sql.OpenDB(f)
+	t.Cleanup(func() {
+		(*db).Close()
+		*db = previous
+	})
+	return f
+}
+
+// OnQuery answers queries containing match with the given rows
+func (f *DB) OnQuery(match string, columns []string, rows ...[]driver.Value) {
+	f.responses = append(f.responses, &response{match: match, columns: columns, rows: rows})
+}
+
+// OnExec answers statements containing match with a rows-affected count
+func (f *DB) OnExec(match string, rowsAffected int64) {
+	f.responses = append(f.responses, &response{match: match, rowsAffected: rowsAffected})
+}
+
+// OnError fails statements containing match with err
+func (f *DB) OnError(match string, err error) {
+	f.responses = append(f.responses, &response{match: match, err: err})
+}
+
+// Ran reports whether a statement containing match was executed
+func (f *DB) Ran(match string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.executed {
+		if strings.Contains(s.query, match) {
+			return true
+		}
+	}
+	return false
+}
+
+// Args returns the arguments of the first executed statement containing
+// match, or nil if none ran
+func (f *DB) Args(match string) []driver.Value {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.executed {
+		if strings.Contains(s.query, match) {
+			return s.args
+		}
+	}
+	return nil
+}
+
+func (f *DB) lookup(query string, args []driver.Value) (*response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.executed = append(f.executed, statement{query, args})
+	for _, r := range f.responses {
+		if strings.Contains(query, r.match) {
+			return r, r.err
+		}
+	}
+	return nil, fmt.Errorf("fakedb: unexpected query %q", query)
+}
+
+func (f *DB) Connect(context.Context) (driver.Conn, error) { return &conn{f}, nil }
+func (f *DB) Driver() driver.Driver                        { return nil }
+
+type conn struct{ db *DB }
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) { return &stmt{c.db, query}, nil }
+func (c *conn) Close() error                              { return nil }
+func (c *conn) Begin() (driver.Tx, error)                 { return tx{}, nil }
+
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+type stmt struct {
+	db    *DB
+	query string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	r, err := s.db.lookup(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(r.rowsAffected), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	r, err := s.db.lookup(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &resultRows{columns: r.columns, rows: r.rows}, nil
+}
+
+type resultRows struct {
+	columns []string
+	rows    [][]driver.Value
+	pos     int
+}
+
+func (r *resultRows) Columns() []string { return r.columns }
+func (r *resultRows) Close() error      { return nil }
+
+func (r *resultRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
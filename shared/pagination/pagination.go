@@ -0,0 +1,56 @@
+// Package pagination reads page sizes and keyset cursors shared by the list
+// endpoints of every service
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// ErrInvalidCursor is returned for cursors that were not made by
+// EncodeKeyCursor
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Limit reads the limit query parameter
+func Limit(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("limit")
+	if raw == "" {
+		return DefaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > MaxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+	}
+	return limit, nil
+}
+
+// EncodeKeyCursor makes an opaque cursor from any sort key and a row id
+func EncodeKeyCursor(key string, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key + "|" + strconv.Itoa(id)))
+}
+
+// DecodeKeyCursor reverses EncodeKeyCursor
+func DecodeKeyCursor(cursor string) (string, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	sep := strings.LastIndex(string(raw), "|")
+	if sep < 0 {
+		return "", 0, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(string(raw[sep+1:]))
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	return string(raw[:sep]), id, nil
+}
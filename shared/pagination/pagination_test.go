@@ -0,0 +1,41 @@
+package pagination
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyCursorRoundTrip(t *testing.T) {
+	// Keys may contain the separator themselves
+	for _, key := range []string{"2024-05-01T10:00:00Z", "a|b", ""} {
+		gotKey, gotID, err := DecodeKeyCursor(EncodeKeyCursor(key, 42))
+		if err != nil || gotKey != key || gotID != 42 {
+			t.Errorf("%q: decoded %q, %d, %v", key, gotKey, gotID, err)
+		}
+	}
+	for _, cursor := range []string{"not base64!", EncodeKeyCursor("x", 1)[:2], "bm9zZXA"} {
+		if _, _, err := DecodeKeyCursor(cursor); err != ErrInvalidCursor {
+			t.Errorf("%q: err = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+		valid bool
+	}{
+		{"", DefaultPageSize, true},
+		{"?limit=5", 5, true},
+		{"?limit=0", 0, false},
+		{"?limit=1000", 0, false},
+		{"?limit=ten", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := Limit(httptest.NewRequest("GET", "/"+tt.query, nil))
+		if (err == nil) != tt.valid || got != tt.want {
+			t.Errorf("%q: Limit = %d, %v", tt.query, got, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Package userclient looks up user summaries from the user-service so that
+// posts and comments can show their authors.
+package userclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxBatch is the most ids the user-service accepts in one lookup
+const MaxBatch = 100
+
+// maxCached bounds the cache. Expired entries are pruned once it fills up,
+// and if that is not enough, arbitrary ones go too.
+const maxCached = 10000
+
+// Author is the summary of a user embedded in posts and comments
+type Author struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar,omitempty"`
+}
+
+// Client fetches authors in batches and caches them briefly
+type Client struct {
+	baseURL string
+	http    *http.Client
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	cache     map[int]cachedAuthor
+	maxCached int
+}
+
+type cachedAuthor struct {
+	author  *Author // nil when the user does not exist
+	expires time.Time
+}
+
+// New returns a client for the user-service at baseURL. Authors are cached
+// for ttl; zero disables caching.
+func New(baseURL string, ttl time.Duration) *Client {
+	return &Client{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		http:      &http.Client{Timeout: 3 * time.Second},
+		ttl:       ttl,
+		cache:     map[int]cachedAuthor{},
+		maxCached: maxCached,
+	}
+}
+
+// Embed looks up the authors of n items, where userID(i) is the author of
+// item i or nil once their account is gone, and passes each author found to
+// set(i, author)
+func (c *Client) Embed(ctx context.Context, n int, userID func(int) *int, set func(int, Author)) error {
+	var ids []int
+	for i := 0; i < n; i++ {
+		if id := userID(i); id != nil {
+			ids = append(ids, *id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	authors, err := c.Authors(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if id := userID(i); id != nil {
+			if author, ok := authors[*id]; ok {
+				set(i, author)
+			}
+		}
+	}
+	return nil
+}
+
+// Expand embeds the authors of n items, as Embed does, when the request asks
+// for ?expand=author. If the user-service cannot be reached the items are
+// still returned, just without authors.
+func (c *Client) Expand(r *http.Request, n int, userID func(int) *int, set func(int, Author)) {
+	if r.URL.Query().Get("expand") != "author" {
+		return
+	}
+	if err := c.Embed(r.Context(), n, userID, set); err != nil {
+		log.Printf("Error looking up authors: %v", err)
+	}
+}
+
+// Authors returns the authors with the given ids. Users that do not exist
+// or are being deleted are missing from the map.
+func (c *Client) Authors(ctx context.Context, ids []int) (map[int]Author, error) {
+	authors := map[int]Author{}
+	var missing []int
+	seen := map[int]bool{}
+	now := time.Now()
+
+	c.mu.Lock()
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if cached, ok := c.cache[id]; ok && now.Before(cached.expires) {
+			if cached.author != nil {
+				authors[id] = *cached.author
+			}
+			continue
+		}
+		missing = append(missing, id)
+	}
+	c.mu.Unlock()
+
+	sort.Ints(missing)
+	for start := 0; start < len(missing); start += MaxBatch {
+		end := start + MaxBatch
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batch := missing[start:end]
+		found, err := c.fetch(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		for _, id := range batch {
+			entry := cachedAuthor{expires: now.Add(c.ttl)}
+			if author, ok := found[id]; ok {
+				authors[id] = author
+				entry.author = &author
+			}
+			if c.ttl > 0 {
+				if len(c.cache) >= c.maxCached {
+					c.prune(now)
+				}
+				c.cache[id] = entry
+			}
+		}
+		c.mu.Unlock()
+	}
+	return authors, nil
+}
+
+// prune makes room in the cache, first by dropping expired entries and then,
+// if it is still full, by dropping whichever entries map iteration yields
+// first. Callers hold c.mu.
+func (c *Client) prune(now time.Time) {
+	for id, cached := range c.cache {
+		if !now.Before(cached.expires) {
+			delete(c.cache, id)
+		}
+	}
+	for id := range c.cache {
+		if len(c.cache) < c.maxCached {
+			break
+		}
+		delete(c.cache, id)
+	}
+}
+
+// fetch asks the user-service for one batch of users
+func (c *Client) fetch(ctx context.Context, ids []int) (map[int]Author, error) {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/users?ids="+url.QueryEscape(strings.Join(parts, ",")), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("user-service returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var body struct {
+		Users []struct {
+			ID        int    `json:"id"`
+			Username  string `json:"username"`
+			AvatarURL string `json:"avatar_url"`
+		} `json:"users"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	found := make(map[int]Author, len(body.Users))
+	for _, u := range body.Users {
+		found[u.ID] = Author{ID: u.ID, Username: u.Username, Avatar: u.AvatarURL}
+	}
+	return found, nil
+}
@@ -0,0 +1,159 @@
+package userclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUserService serves GET /users?ids= for users 1 to 150 and counts
+// the requests it receives
+func startUserService(t *testing.T, requests *[]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.URL.Query().Get("ids"))
+		users := []map[string]interface{}{}
+		for _, raw := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			id, _ := strconv.Atoi(raw)
+			if id >= 1 && id <= 150 {
+				users = append(users, map[string]interface{}{"id": id, "username": "user" + raw, "avatar_url": "https://cdn/" + raw})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"users": users})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAuthors(t *testing.T) {
+	var requests []string
+	client := New(startUserService(t, &requests).URL, time.Minute)
+
+	authors, err := client.Authors(context.Background(), []int{2, 1, 2, 999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authors) != 2 || authors[1].Username != "user1" || authors[2].Avatar != "https://cdn/2" {
+		t.Errorf("unexpected authors %+v", authors)
+	}
+	if len(requests) != 1 || requests[0] != "1,2,999" {
+		t.Errorf("requests = %v, want one batch of distinct ids", requests)
+	}
+
+	// Known and unknown users are both served from the cache
+	if _, err := client.Authors(context.Background(), []int{1, 999}); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("cached lookups made %d more requests", len(requests)-1)
+	}
+}
+
+func TestAuthorsBatches(t *testing.T) {
+	var requests []string
+	client := New(startUserService(t, &requests).URL, 0)
+
+	ids := make([]int, 150)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	authors, err := client.Authors(context.Background(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authors) != 150 || len(requests) != 2 {
+		t.Errorf("got %d authors in %d requests, want 150 in 2", len(authors), len(requests))
+	}
+}
+
+func TestAuthorsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database unavailable", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if _, err := New(server.URL, time.Minute).Authors(context.Background(), []int{1}); err == nil {
+		t.Error("expected an error from a failing user-service")
+	}
+}
+
+func TestAuthorsCacheIsBounded(t *testing.T) {
+	var requests []string
+	client := New(startUserService(t, &requests).URL, time.Minute)
+	client.maxCached = 10
+
+	// Expired entries make room first
+	client.cache[500] = cachedAuthor{expires: time.Now().Add(-time.Second)}
+	for id := 1; id <= 25; id++ {
+		if _, err := client.Authors(context.Background(), []int{id}); err != nil {
+			t.Fatal(err)
+		}
+		if len(client.cache) > client.maxCached {
+			t.Fatalf("cache holds %d entries, want at most %d", len(client.cache), client.maxCached)
+		}
+	}
+	if _, ok := client.cache[500]; ok {
+		t.Error("expired entry survived pruning")
+	}
+	if _, ok := client.cache[25]; !ok {
+		t.Error("newest entry was not cached")
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	var requests []string
+	client := New(startUserService(t, &requests).URL, 0)
+
+	one, unknown := 1, 999
+	owners := []*int{&one, nil, &unknown, &one}
+	embedded := map[int]string{}
+	err := client.Embed(context.Background(), len(owners),
+		func(i int) *int { return owners[i] },
+		func(i int, author Author) { embedded[i] = author.Username })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embedded) != 2 || embedded[0] != "user1" || embedded[3] != "user1" {
+		t.Errorf("embedded = %v, want user1 at 0 and 3", embedded)
+	}
+
+	// Nothing to look up makes no request
+	requests = nil
+	if err := client.Embed(context.Background(), 1, func(int) *int { return nil }, nil); err != nil || len(requests) != 0 {
+		t.Errorf("Embed without authors = %v after %d requests", err, len(requests))
+	}
+}
+
+func TestExpand(t *testing.T) {
+	var requests []string
+	client := New(startUserService(t, &requests).URL, 0)
+	one := 1
+
+	for _, target := range []string{"/posts", "/posts?expand=tags"} {
+		client.Expand(httptest.NewRequest("GET", target, nil), 1,
+			func(int) *int { return &one },
+			func(int, Author) { t.Errorf("%s: author embedded without ?expand=author", target) })
+	}
+	if len(requests) != 0 {
+		t.Errorf("made %d requests without ?expand=author", len(requests))
+	}
+
+	var embedded string
+	client.Expand(httptest.NewRequest("GET", "/posts?expand=author", nil), 1,
+		func(int) *int { return &one },
+		func(_ int, author Author) { embedded = author.Username })
+	if embedded != "user1" {
+		t.Errorf("embedded %q, want user1", embedded)
+	}
+
+	// An unreachable user-service leaves the items without authors
+	down := New("http://127.0.0.1:1", 0)
+	down.Expand(httptest.NewRequest("GET", "/posts?expand=author", nil), 1,
+		func(int) *int { return &one },
+		func(int, Author) { t.Error("author embedded although the lookup failed") })
+}
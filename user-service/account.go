@@ -0,0 +1,464 @@
+// Account deletion and data export (account.go)
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Deletion modes decide what happens to a deleted user's posts and comments
+const (
+	deletionModeCascade   = "cascade"
+	deletionModeAnonymize = "anonymize"
+)
+
+// DeleteAccountRequest confirms an account deletion
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+	Mode     string `json:"mode"`
+}
+
+// DeletionResponse tells the user when their account will be removed
+type DeletionResponse struct {
+	Mode         string    `json:"mode"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+}
+
+// AccountExport is everything the service stores about a user
+type AccountExport struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	Profile    UserResponse      `json:"profile"`
+	Roles      []string          `json:"roles"`
+	Identities []Identity        `json:"identities"`
+	Posts      []ExportedPost    `json:"posts"`
+	Comments   []ExportedComment `json:"comments"`
+}
+
+// ExportedPost is a post written by the exported user
+type ExportedPost struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ExportedComment is a comment written by the exported user
+type ExportedComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// accountDeletionGrace returns how long a deleted account can still be restored
+func accountDeletionGrace() time.Duration {
+	return envDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour)
+}
+
+// deleteUser schedules an account for deletion after the grace period and
+// signs it out everywhere. Users must confirm with their password; holders
+// of users:manage may delete any account.
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authorizeSelf(w, r, id) {
+		return
+	}
+	claims, _ := auth.FromContext(r.Context())
+
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = deletionModeAnonymize
+	}
+	if req.Mode != deletionModeCascade && req.Mode != deletionModeAnonymize {
+		http.Error(w, "mode must be cascade or anonymize", http.StatusBadRequest)
+		return
+	}
+
+	var hashedPassword string
+	var scheduledFor sql.NullTime
+	err := db.QueryRow("SELECT password_hash, deletion_scheduled_for FROM users WHERE id = $1", id).Scan(&hashedPassword, &scheduledFor)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if scheduledFor.Valid {
+		http.Error(w, "Account is already scheduled for deletion", http.StatusConflict)
+		return
+	}
+
+	// Accounts created through single sign-on have no password to confirm
+	// with, so they must have signed in again a moment ago instead
+	if strconv.Itoa(claims.UserID) == id && hashedPassword == "!" {
+		recent, err := signedInRecently(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !recent {
+			http.Error(w, "Sign in again to confirm the deletion", http.StatusForbidden)
+			return
+		}
+	} else if strconv.Itoa(claims.UserID) == id && checkPassword(hashedPassword, req.Password) != nil {
+		http.Error(w, "Password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	response := DeletionResponse{Mode: req.Mode, ScheduledFor: time.Now().Add(accountDeletionGrace())}
+	_, err = tx.Exec(
+		"UPDATE users SET deletion_scheduled_for = $1, deletion_mode = $2 WHERE id = $3",
+		response.ScheduledFor, response.Mode, id,
+	)
+	if err != nil {
+		http.Error(w, "Error scheduling deletion: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		"UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = 'account_deleted' WHERE user_id = $1 AND revoked_at IS NULL",
+		id,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE personal_access_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userID, _ := strconv.Atoi(id)
+	details := fmt.Sprintf("%s deletion requested by user %d", req.Mode, claims.UserID)
+	if err := recordSecurityEvent(sql.NullInt64{Int64: int64(userID), Valid: true}, "account_deletion_requested", clientIP(r), details); err != nil {
+		log.Printf("Error recording deletion of user %d: %v", userID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// reauthWindow is how recently a user without a password must have signed in
+// to confirm a sensitive change
+const reauthWindow = 5 * time.Minute
+
+// signedInRecently reports whether the session behind the caller's token
+// was started within reauthWindow
+func signedInRecently(claims *auth.Claims) (bool, error) {
+	if claims.SessionID == 0 {
+		return false, nil
+	}
+	var signedIn time.Time
+	err := db.QueryRow("SELECT created_at FROM sessions WHERE id = $1", claims.SessionID).Scan(&signedIn)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return signedIn.After(clock().Add(-reauthWindow)), nil
+}
+
+// cancelAccountDeletion clears a pending deletion and reports whether there was one
+func cancelAccountDeletion(userID int) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE users SET deletion_scheduled_for = NULL, deletion_mode = NULL WHERE id = $1 AND deletion_scheduled_for IS NOT NULL",
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, recordSecurityEvent(sql.NullInt64{Int64: int64(userID), Valid: true}, "account_deletion_cancelled", "", "")
+}
+
+// restoreUser cancels a pending deletion on behalf of a user
+func restoreUser(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	cancelled, err := cancelAccountDeletion(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		http.Error(w, "Account is not scheduled for deletion", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeDeletedAccounts removes accounts whose grace period has ended and
+// returns how many were removed
+func purgeDeletedAccounts() (int, error) {
+	const batchSize = 100
+	purged := 0
+	for {
+		rows, err := db.Query(
+			"SELECT id FROM users WHERE deletion_scheduled_for <= CURRENT_TIMESTAMP ORDER BY deletion_scheduled_for LIMIT $1",
+			batchSize,
+		)
+		if err != nil {
+			return purged, err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return purged, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		batchPurged := 0
+		for _, id := range ids {
+			ok, err := purgeAccount(id)
+			if err != nil {
+				return purged, err
+			}
+			if ok {
+				batchPurged++
+			}
+		}
+		purged += batchPurged
+
+		// Stop when the backlog is done or every account left is busy elsewhere
+		if len(ids) < batchSize || batchPurged == 0 {
+			return purged, nil
+		}
+	}
+}
+
+// purgeAccount deletes one account whose grace period has ended. In
+// anonymize mode its posts and comments are kept without an author;
+// otherwise they are deleted along with the account. It reports false if
+// the account was restored or is being purged by another replica.
+func purgeAccount(userID int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var mode string
+	var avatarPrefix sql.NullString
+	err = tx.QueryRow(
+		`SELECT deletion_mode, avatar_key FROM users
+		WHERE id = $1 AND deletion_scheduled_for <= CURRENT_TIMESTAMP
+		FOR UPDATE SKIP LOCKED`,
+		userID,
+	).Scan(&mode, &avatarPrefix)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if mode == deletionModeAnonymize {
+		if _, err := tx.Exec("UPDATE posts SET user_id = NULL WHERE user_id = $1", userID); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec("UPDATE comments SET user_id = NULL WHERE user_id = $1", userID); err != nil {
+			return false, err
+		}
+	}
+	// Everything else, including posts and comments in cascade mode, goes with the row
+	if _, err := tx.Exec("DELETE FROM users WHERE id = $1", userID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	if avatarPrefix.Valid && avatarPrefix.String != "" {
+		deleteAvatar(avatarPrefix.String)
+	}
+	return true, nil
+}
+
+// runAccountPurger purges deleted accounts every ACCOUNT_PURGE_INTERVAL
+func runAccountPurger() {
+	ticker := time.NewTicker(envDuration("ACCOUNT_PURGE_INTERVAL", time.Hour))
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := purgeDeletedAccounts()
+		if err != nil {
+			log.Printf("Error purging deleted accounts: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Purged %d deleted accounts", n)
+		}
+	}
+}
+
+// exportUser returns a copy of the user's data as JSON, or as a ZIP archive
+// with ?format=zip
+func exportUser(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authorizeSelf(w, r, id) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		http.Error(w, "format must be json or zip", http.StatusBadRequest)
+		return
+	}
+
+	export, err := loadAccountExport(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error exporting data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("user-%s-export-%s", id, export.ExportedAt.Format("20060102"))
+	w.Header().Set("Cache-Control", "no-store")
+	if format != "zip" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		json.NewEncoder(w).Encode(export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"account.json", map[string]interface{}{
+			"exported_at": export.ExportedAt,
+			"profile":     export.Profile,
+			"roles":       export.Roles,
+			"identities":  export.Identities,
+		}},
+		{"posts.json", export.Posts},
+		{"comments.json", export.Comments},
+	}
+	for _, f := range files {
+		fw, err := archive.Create(f.name)
+		if err != nil {
+			log.Printf("Error writing export for user %s: %v", id, err)
+			return
+		}
+		encoder := json.NewEncoder(fw)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(f.data); err != nil {
+			log.Printf("Error writing export for user %s: %v", id, err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Error writing export for user %s: %v", id, err)
+	}
+}
+
+// loadAccountExport gathers the user's profile, posts and comments. The
+// services share a database, so posts and comments are read directly.
+func loadAccountExport(id string) (*AccountExport, error) {
+	export := &AccountExport{
+		ExportedAt: time.Now().UTC(),
+		Identities: []Identity{},
+		Posts:      []ExportedPost{},
+		Comments:   []ExportedComment{},
+	}
+
+	user, err := scanUserProfile(db.QueryRow("SELECT "+userProfileColumns+" FROM users WHERE id = $1", id))
+	if err != nil {
+		return nil, err
+	}
+	export.Profile = newUserResponse(user)
+	err = db.QueryRow(
+		`SELECT COALESCE(array_agg(r.name ORDER BY r.name), '{}')
+		FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = $1`,
+		id,
+	).Scan(pq.Array(&export.Roles))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT provider, subject, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at", id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var i Identity
+		var email sql.NullString
+		if err := rows.Scan(&i.Provider, &i.Subject, &email, &i.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		i.Email = email.String
+		export.Identities = append(export.Identities, i)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT id, title, content, created_at, updated_at FROM posts WHERE user_id = $1 ORDER BY created_at", id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var post ExportedPost
+		if err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Posts = append(export.Posts, post)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT id, post_id, content, created_at, updated_at FROM comments WHERE user_id = $1 ORDER BY created_at", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var comment ExportedComment
+		if err := rows.Scan(&comment.ID, &comment.PostID, &comment.Content, &comment.CreatedAt, &comment.UpdatedAt); err != nil {
+			return nil, err
+		}
+		export.Comments = append(export.Comments, comment)
+	}
+
+	return export, rows.Err()
+}
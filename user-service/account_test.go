@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDeleteUser(t *testing.T) {
+	tokens = testTokenConfig()
+	hash, err := bcrypt.GenerateFromPassword([]byte("my-password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		userID      string
+		permissions []string
+		body        string
+		scheduled   driver.Value
+		wantStatus  int
+	}{
+		{"self with password", "1", nil, `{"password":"my-password1","mode":"cascade"}`, nil, http.StatusAccepted},
+		{"self with wrong password", "1", nil, `{"password":"guess-1234"}`, nil, http.StatusForbidden},
+		{"unknown mode", "1", nil, `{"password":"my-password1","mode":"shred"}`, nil, http.StatusBadRequest},
+		{"already scheduled", "1", nil, `{"password":"my-password1"}`, time.Now().Add(time.Hour), http.StatusConflict},
+		{"someone else's account", "2", nil, `{"password":"my-password1"}`, nil, http.StatusForbidden},
+		{"admin without password", "2", []string{"users:manage"}, `{}`, nil, http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT password_hash, deletion_scheduled_for", []string{"password_hash", "deletion_scheduled_for"},
+				[]driver.Value{string(hash), tt.scheduled})
+			fake.OnExec("UPDATE users", 1)
+			fake.OnExec("UPDATE sessions", 2)
+			fake.OnExec("UPDATE personal_access_tokens", 1)
+			fake.OnExec("INSERT INTO security_events", 1)
+
+			req := httptest.NewRequest("DELETE", "/users/"+tt.userID, strings.NewReader(tt.body))
+			req = mux.SetURLVars(req, map[string]string{"id": tt.userID})
+			req.Header.Set("Authorization", bearer(t, 1, tt.permissions...))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(deleteUser)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			success := tt.wantStatus == http.StatusAccepted
+			if fake.Ran("UPDATE sessions") != success {
+				t.Errorf("sessions revoked = %v, want %v", fake.Ran("UPDATE sessions"), success)
+			}
+		})
+	}
+}
+
+func TestDeleteUserWithoutPassword(t *testing.T) {
+	tokens = testTokenConfig()
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		signedIn   time.Time
+		wantStatus int
+	}{
+		{"just signed in", now.Add(-time.Minute), http.StatusAccepted},
+		{"signed in long ago", now.Add(-2 * time.Hour), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("expires_at > CURRENT_TIMESTAMP FROM sessions", []string{"active"}, []driver.Value{true})
+			fake.OnQuery("SELECT created_at FROM sessions", []string{"created_at"}, []driver.Value{tt.signedIn})
+			fake.OnQuery("SELECT password_hash, deletion_scheduled_for", []string{"password_hash", "deletion_scheduled_for"},
+				[]driver.Value{"!", nil})
+			fake.OnExec("UPDATE users", 1)
+			fake.OnExec("UPDATE sessions", 2)
+			fake.OnExec("UPDATE personal_access_tokens", 1)
+			fake.OnExec("INSERT INTO security_events", 1)
+
+			token, err := tokens.sign(auth.Claims{
+				Subject: "1", Issuer: tokens.issuer, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(),
+				UserID: 1, Username: "sso", SessionID: 4,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("DELETE", "/users/1", strings.NewReader(`{}`))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(deleteUser)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if fake.Ran("UPDATE users") != (tt.wantStatus == http.StatusAccepted) {
+				t.Errorf("deletion scheduled = %v", fake.Ran("UPDATE users"))
+			}
+		})
+	}
+}
+
+func TestPurgeAccount(t *testing.T) {
+	for _, mode := range []string{deletionModeAnonymize, deletionModeCascade} {
+		fake := useFakeDB(t)
+		fake.OnQuery("SELECT deletion_mode", []string{"deletion_mode", "avatar_key"}, []driver.Value{mode, nil})
+		fake.OnExec("UPDATE posts", 3)
+		fake.OnExec("UPDATE comments", 5)
+		fake.OnExec("DELETE FROM users", 1)
+
+		purged, err := purgeAccount(7)
+		if err != nil || !purged {
+			t.Fatalf("%s: purgeAccount = %v, %v", mode, purged, err)
+		}
+		anonymized := mode == deletionModeAnonymize
+		if fake.Ran("UPDATE posts") != anonymized || fake.Ran("UPDATE comments") != anonymized {
+			t.Errorf("%s: content anonymized = %v, want %v", mode, fake.Ran("UPDATE posts"), anonymized)
+		}
+		if !fake.Ran("DELETE FROM users") {
+			t.Errorf("%s: account not deleted", mode)
+		}
+	}
+}
+
+func TestExportUserZip(t *testing.T) {
+	tokens = testTokenConfig()
+	now := time.Now()
+	fake := useFakeDB(t)
+	fake.OnQuery("FROM users WHERE id", profileColumns, []driver.Value{int64(1), "alice", "alice@example.com", true,
+		"Alice", "Writes about Go", "{https://alice.dev}", "https://cdn.example.com/avatars/1.jpg", false, now, now})
+	fake.OnQuery("FROM user_roles", []string{"roles"}, []driver.Value{"{author}"})
+	fake.OnQuery("FROM user_identities", []string{"provider", "subject", "email", "created_at"})
+	fake.OnQuery("FROM posts", []string{"id", "title", "content", "created_at", "updated_at"},
+		[]driver.Value{int64(4), "Hello", "First post", now, now})
+	fake.OnQuery("FROM comments", []string{"id", "post_id", "content", "created_at", "updated_at"},
+		[]driver.Value{int64(9), int64(4), "Nice", now, now})
+
+	req := httptest.NewRequest("GET", "/users/1/export?format=zip", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req.Header.Set("Authorization", bearer(t, 1))
+	rec := httptest.NewRecorder()
+	authn.RequireAuth(exportUser)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(r)
+		r.Close()
+		contents[f.Name] = buf.String()
+	}
+	for name, want := range map[string]string{"account.json": "alice@example.com", "posts.json": "First post", "comments.json": "Nice"} {
+		if !strings.Contains(contents[name], want) {
+			t.Errorf("%s missing %q: %s", name, want, contents[name])
+		}
+	}
+
+	// The export carries the whole profile, not just the account
+	var account AccountExport
+	if err := json.Unmarshal([]byte(contents["account.json"]), &account); err != nil {
+		t.Fatal(err)
+	}
+	p := account.Profile
+	if p.DisplayName != "Alice" || p.Bio != "Writes about Go" || len(p.Links) != 1 || p.Links[0] != "https://alice.dev" ||
+		p.AvatarURL != "https://cdn.example.com/avatars/1.jpg" || len(account.Roles) != 1 {
+		t.Errorf("incomplete profile %+v, roles %v", p, account.Roles)
+	}
+}
@@ -0,0 +1,362 @@
+// Avatar uploads and image processing (avatar.go)
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// avatarSizes are the square renditions stored for every upload, largest
+// first. The largest one becomes the profile's avatar_url.
+var avatarSizes = []int{512, 128, 64}
+
+const (
+	defaultMaxAvatarBytes = 5 << 20
+	maxAvatarPixels       = 40_000_000
+	avatarJPEGQuality     = 85
+)
+
+// allowedAvatarTypes are the formats accepted for upload
+var allowedAvatarTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+var (
+	errAvatarType       = errors.New("Avatar must be a JPEG, PNG or GIF image")
+	errAvatarDimensions = fmt.Errorf("Avatar must be at most %d megapixels", maxAvatarPixels/1_000_000)
+)
+
+// AvatarResponse lists the URLs of an uploaded avatar's renditions
+type AvatarResponse struct {
+	AvatarURL string            `json:"avatar_url"`
+	Sizes     map[string]string `json:"sizes"`
+}
+
+// uploadAvatar handles PUT /users/{id}/avatar with the image in the
+// "avatar" field of a multipart form
+func uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authorizeSelf(w, r, id) {
+		return
+	}
+
+	maxBytes := envInt("AVATAR_MAX_BYTES", defaultMaxAvatarBytes)
+	data, status, err := readAvatarPart(w, r, maxBytes)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	renditions, err := processAvatar(data)
+	if err == errAvatarType {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	version := make([]byte, 8)
+	if _, err := rand.Read(version); err != nil {
+		http.Error(w, "Error storing avatar", http.StatusInternalServerError)
+		return
+	}
+	// Every upload gets fresh keys so the files can be cached forever
+	prefix := fmt.Sprintf("avatars/%s/%s", id, hex.EncodeToString(version))
+
+	ctx := r.Context()
+	for _, size := range avatarSizes {
+		if err := storage.Put(ctx, avatarKey(prefix, size), "image/jpeg", renditions[size]); err != nil {
+			deleteAvatar(prefix)
+			http.Error(w, "Error storing avatar: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	avatarURL := storage.URL(avatarKey(prefix, avatarSizes[0]))
+	var oldPrefix sql.NullString
+	err = db.QueryRow(
+		`UPDATE users u SET avatar_url = $1, avatar_key = $2, updated_at = CURRENT_TIMESTAMP
+		FROM users old WHERE u.id = $3 AND old.id = u.id AND u.deletion_scheduled_for IS NULL
+		RETURNING old.avatar_key`,
+		avatarURL, prefix, id,
+	).Scan(&oldPrefix)
+	if err != nil {
+		deleteAvatar(prefix)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error updating avatar: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if oldPrefix.Valid && oldPrefix.String != "" {
+		deleteAvatar(oldPrefix.String)
+	}
+
+	response := AvatarResponse{AvatarURL: avatarURL, Sizes: map[string]string{}}
+	for _, size := range avatarSizes {
+		response.Sizes[strconv.Itoa(size)] = storage.URL(avatarKey(prefix, size))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// readAvatarPart streams the multipart body and returns the avatar file,
+// refusing anything larger than maxBytes without buffering it
+func readAvatarPart(w http.ResponseWriter, r *http.Request, maxBytes int) ([]byte, int, error) {
+	// Allow some room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes)+64<<10)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Request must be multipart/form-data")
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.StatusBadRequest, errors.New("Missing avatar file")
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("Avatar must be at most %d bytes", maxBytes)
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Invalid multipart body")
+		}
+		if part.FormName() != "avatar" {
+			part.Close()
+			continue
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if !allowedAvatarTypes[mediaType] {
+			return nil, http.StatusUnsupportedMediaType, errAvatarType
+		}
+		data, err := io.ReadAll(io.LimitReader(part, int64(maxBytes)+1))
+		if errors.As(err, &tooLarge) || len(data) > maxBytes {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("Avatar must be at most %d bytes", maxBytes)
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Invalid multipart body")
+		}
+		return data, 0, nil
+	}
+}
+
+// processAvatar decodes an uploaded image and renders it as square JPEGs in
+// every avatar size. Re-encoding drops EXIF and any other metadata; the EXIF
+// orientation is applied first so that photos keep the right way up.
+func processAvatar(data []byte) (map[int][]byte, error) {
+	// Trust the bytes rather than the declared type
+	if !allowedAvatarTypes[http.DetectContentType(data)] {
+		return nil, errAvatarType
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarType
+	}
+	if config.Width*config.Height > maxAvatarPixels {
+		return nil, errAvatarDimensions
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode avatar: %v", err)
+	}
+
+	// Flatten onto white so transparent PNGs and GIFs survive JPEG encoding
+	bounds := src.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, bounds.Min, draw.Over)
+
+	orientation := jpegOrientation(data)
+	renditions := make(map[int][]byte, len(avatarSizes))
+	for _, size := range avatarSizes {
+		// The centre square crop does not depend on orientation, so rotate
+		// the small result rather than the full image
+		img := orient(resizeSquare(flat, size), orientation)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+			return nil, err
+		}
+		renditions[size] = buf.Bytes()
+	}
+	return renditions, nil
+}
+
+// resizeSquare crops the centre square of img and scales it to size×size,
+// averaging the source pixels that fall into each output pixel
+func resizeSquare(img *image.RGBA, size int) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	side := w
+	if h < side {
+		side = h
+	}
+	x0, y0 := (w-side)/2, (h-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0, sy1 := y0+dy*side/size, y0+(dy+1)*side/size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			sx0, sx1 := x0+dx*side/size, x0+(dx+1)*side/size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, n int
+			for sy := sy0; sy < sy1; sy++ {
+				row := img.Pix[sy*img.Stride:]
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(row[sx*4])
+					g += int(row[sx*4+1])
+					b += int(row[sx*4+2])
+					n++
+				}
+			}
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// orient transforms a square image according to an EXIF orientation value
+// so that it displays upright without the tag
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	n := img.Bounds().Dx() - 1
+	dst := image.NewRGBA(img.Bounds())
+	for y := 0; y <= n; y++ {
+		for x := 0; x <= n; x++ {
+			// (sx, sy) is the stored pixel that displays at (x, y)
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = n-x, y
+			case 3:
+				sx, sy = n-x, n-y
+			case 4:
+				sx, sy = x, n-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, n-x
+			case 7:
+				sx, sy = n-y, n-x
+			case 8:
+				sx, sy = n-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[img.PixOffset(sx, sy):img.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 when the
+// data is not a JPEG or carries no orientation tag
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		// Metadata segments all come before the start of scan
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from IFD0 of a TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value < 1 || value > 8 {
+				return 1
+			}
+			return value
+		}
+	}
+	return 1
+}
+
+// avatarKey is the storage key of one rendition of an upload
+func avatarKey(prefix string, size int) string {
+	return fmt.Sprintf("%s-%d.jpg", prefix, size)
+}
+
+// deleteAvatar removes every rendition of an upload. Failures only leave
+// orphaned files behind, so they are logged rather than returned.
+func deleteAvatar(prefix string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, size := range avatarSizes {
+		if err := storage.Delete(ctx, avatarKey(prefix, size)); err != nil {
+			log.Printf("Error deleting avatar %s: %v", avatarKey(prefix, size), err)
+		}
+	}
+}
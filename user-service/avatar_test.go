@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// testPhoto encodes a 40×20 JPEG, red on the left and blue on the right,
+// carrying an EXIF orientation tag
+func testPhoto(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 20 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Big-endian TIFF with a single IFD0 entry: orientation, SHORT, count 1
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01")
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	segment := append([]byte{0xFF, 0xE1}, binary.BigEndian.AppendUint16(nil, uint16(len(app1)+2))...)
+	segment = append(segment, app1...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestProcessAvatarOrientation(t *testing.T) {
+	photo := testPhoto(t, 6)
+	if got := jpegOrientation(photo); got != 6 {
+		t.Fatalf("jpegOrientation = %d, want 6", got)
+	}
+
+	renditions, err := processAvatar(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range avatarSizes {
+		data := renditions[size]
+		if bytes.Contains(data, []byte("Exif")) {
+			t.Errorf("%d: EXIF data was not stripped", size)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("rendition is %dx%d, want %dx%d", b.Dx(), b.Dy(), size, size)
+		}
+		// Rotated upright, the red half of the crop is on top
+		top, _, _, _ := img.At(size/2, size/8).RGBA()
+		bottom, _, _, _ := img.At(size/2, size-size/8).RGBA()
+		if top < 0xc000 || bottom > 0x4000 {
+			t.Errorf("%d: red channel top = %#x, bottom = %#x; orientation not applied", size, top, bottom)
+		}
+	}
+}
+
+func TestProcessAvatarRejectsNonImages(t *testing.T) {
+	for _, data := range [][]byte{
+		[]byte("<svg xmlns='http://www.w3.org/2000/svg'></svg>"),
+		[]byte("GIF89a"),
+		{0xFF, 0xD8, 0xFF, 0xE0, 0x00},
+	} {
+		if _, err := processAvatar(data); err != errAvatarType {
+			t.Errorf("processAvatar(%q) = %v, want %v", data, err, errAvatarType)
+		}
+	}
+}
+
+// multipartAvatar builds an upload request body with one file field
+func multipartAvatar(t *testing.T, field, contentType string, data []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="`+field+`"; filename="me"`)
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+func TestUploadAvatar(t *testing.T) {
+	tokens = testTokenConfig()
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 300, 200)))
+
+	tests := []struct {
+		name        string
+		userID      string
+		field       string
+		contentType string
+		data        []byte
+		maxBytes    string
+		wantStatus  int
+	}{
+		{"png upload", "1", "avatar", "image/png", pngData.Bytes(), "", http.StatusOK},
+		{"someone else's avatar", "2", "avatar", "image/png", pngData.Bytes(), "", http.StatusForbidden},
+		{"missing file", "1", "picture", "image/png", pngData.Bytes(), "", http.StatusBadRequest},
+		{"declared svg", "1", "avatar", "image/svg+xml", pngData.Bytes(), "", http.StatusUnsupportedMediaType},
+		{"png that is not a png", "1", "avatar", "image/png", []byte("<html>hello</html>"), "", http.StatusUnsupportedMediaType},
+		{"too large", "1", "avatar", "image/png", pngData.Bytes(), "100", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			storage = &localStorage{dir: dir, publicURL: "/uploads"}
+			t.Setenv("AVATAR_MAX_BYTES", tt.maxBytes)
+			oldFile := filepath.Join(dir, "avatars", "1", "old-64.jpg")
+			os.MkdirAll(filepath.Dir(oldFile), 0755)
+			os.WriteFile(oldFile, []byte("old"), 0644)
+
+			fake := useFakeDB(t)
+			fake.OnQuery("UPDATE users u SET avatar_url", []string{"avatar_key"}, []driver.Value{"avatars/1/old"})
+
+			body, contentType := multipartAvatar(t, tt.field, tt.contentType, tt.data)
+			req := httptest.NewRequest("PUT", "/users/"+tt.userID+"/avatar", body)
+			req = mux.SetURLVars(req, map[string]string{"id": tt.userID})
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(uploadAvatar)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "avatars", "1", "*.jpg"))
+			if tt.wantStatus != http.StatusOK {
+				if fake.Ran("UPDATE users") || len(files) != 1 {
+					t.Errorf("rejected upload changed the avatar: %v", files)
+				}
+				return
+			}
+			if len(files) != len(avatarSizes) {
+				t.Errorf("stored %v, want one file per size", files)
+			}
+			if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+				t.Error("previous avatar was not deleted")
+			}
+			if !strings.Contains(rec.Body.String(), `"avatar_url":"/uploads/avatars/1/`) {
+				t.Errorf("unexpected response %s", rec.Body.String())
+			}
+		})
+	}
+}
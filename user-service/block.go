@@ -0,0 +1,173 @@
+// Blocking and muting other users (block.go)
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+// RelatedUser is an entry in a user's block or mute list
+type RelatedUser struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// userRelation is a one-way list one user keeps about others
+type userRelation struct {
+	table       string
+	ownerColumn string
+	otherColumn string
+	noun        string
+}
+
+var (
+	blocks = userRelation{"user_blocks", "blocker_id", "blocked_id", "block"}
+	mutes  = userRelation{"user_mutes", "muter_id", "muted_id", "mute"}
+)
+
+// blockUser blocks the user in the URL for the caller. Nothing changes for
+// the blocked user: their comments and follows are kept but hidden from the
+// caller.
+func blockUser(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	id, ok := relationTarget(w, r, blocks)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO user_blocks (blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		claims.UserID, id,
+	)
+	if err != nil {
+		http.Error(w, "Error blocking user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unblockUser removes the user in the URL from the caller's block list
+func unblockUser(w http.ResponseWriter, r *http.Request) {
+	removeRelation(w, r, blocks)
+}
+
+// muteUser hides the comments of the user in the URL from the caller
+func muteUser(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	id, ok := relationTarget(w, r, mutes)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO user_mutes (muter_id, muted_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		claims.UserID, id,
+	)
+	if err != nil {
+		http.Error(w, "Error muting user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unmuteUser removes the user in the URL from the caller's mute list
+func unmuteUser(w http.ResponseWriter, r *http.Request) {
+	removeRelation(w, r, mutes)
+}
+
+// getBlocks lists the users a user has blocked. Only the user can see it.
+func getBlocks(w http.ResponseWriter, r *http.Request) {
+	writeRelationList(w, r, blocks)
+}
+
+// getMutes lists the users a user has muted. Only the user can see it.
+func getMutes(w http.ResponseWriter, r *http.Request) {
+	writeRelationList(w, r, mutes)
+}
+
+// relationTarget reads the user in the URL, rejecting the caller themselves
+// and accounts that do not exist
+func relationTarget(w http.ResponseWriter, r *http.Request, rel userRelation) (int, bool) {
+	claims, _ := auth.FromContext(r.Context())
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if id == claims.UserID {
+		http.Error(w, "You cannot "+rel.noun+" yourself", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var exists bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND deletion_scheduled_for IS NULL)", id,
+	).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+// removeRelation deletes the caller's entry for the user in the URL
+func removeRelation(w http.ResponseWriter, r *http.Request, rel userRelation) {
+	claims, _ := auth.FromContext(r.Context())
+	_, err := db.Exec(
+		"DELETE FROM "+rel.table+" WHERE "+rel.ownerColumn+" = $1 AND "+rel.otherColumn+" = $2",
+		claims.UserID, mux.Vars(r)["id"],
+	)
+	if err != nil {
+		http.Error(w, "Error removing "+rel.noun+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeRelationList returns the users on one of the caller's lists. Lists
+// are private, so not even users:manage may read someone else's.
+func writeRelationList(w http.ResponseWriter, r *http.Request, rel userRelation) {
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != mux.Vars(r)["id"] {
+		http.Error(w, "You can only view your own "+rel.noun+" list", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT u.id, u.username, u.display_name, u.avatar_url, x.created_at
+		FROM `+rel.table+` x JOIN users u ON u.id = x.`+rel.otherColumn+`
+		WHERE x.`+rel.ownerColumn+` = $1
+		ORDER BY x.created_at DESC`,
+		claims.UserID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []RelatedUser{}
+	for rows.Next() {
+		var u RelatedUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.AvatarURL, &u.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBlockUser(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name       string
+		target     string
+		exists     bool
+		wantStatus int
+	}{
+		{"block", "2", true, http.StatusNoContent},
+		{"unknown user", "99", false, http.StatusNotFound},
+		{"yourself", "1", true, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{tt.exists})
+			fake.OnExec("INSERT INTO user_blocks", 1)
+
+			req := httptest.NewRequest("POST", "/users/"+tt.target+"/block", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tt.target})
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(blockUser)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if stored := fake.Ran("INSERT INTO user_blocks"); stored != (tt.wantStatus == http.StatusNoContent) {
+				t.Errorf("block stored = %v", stored)
+			}
+			// The blocked user keeps following and being followed
+			if fake.Ran("follows") {
+				t.Error("blocking touched the follows between the two users")
+			}
+		})
+	}
+}
+
+func TestRelationListsArePrivate(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		userID      string
+		permissions []string
+		wantStatus  int
+	}{
+		{"own blocks", getBlocks, "1", nil, http.StatusOK},
+		{"own mutes", getMutes, "1", nil, http.StatusOK},
+		{"someone else's blocks", getBlocks, "2", nil, http.StatusForbidden},
+		{"user manager reading mutes", getMutes, "2", []string{"users:manage"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT u.id", []string{"id", "username", "display_name", "avatar_url", "created_at"},
+				[]driver.Value{int64(5), "troll", "", "", time.Now()})
+
+			req := httptest.NewRequest("GET", "/users/"+tt.userID+"/blocks", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tt.userID})
+			req.Header.Set("Authorization", bearer(t, 1, tt.permissions...))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(tt.handler)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+// User directory and search (directory.go)
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"blog-shared/auth"
+	"blog-shared/pagination"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxSearchLength = 100
+	maxBatchIDs     = 100
+)
+
+// UserSummary is the short form of a user other services embed as an author
+type UserSummary struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// DirectoryUser is an entry in the user directory
+type DirectoryUser struct {
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	DisplayName   string    `json:"display_name"`
+	AvatarURL     string    `json:"avatar_url,omitempty"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified *bool     `json:"email_verified,omitempty"` // only shown to user managers
+	PostCount     int       `json:"post_count"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// DirectoryPage is one page of the user directory
+type DirectoryPage struct {
+	Users      []DirectoryUser `json:"users"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// directorySort describes one way of ordering the directory. key is the
+// column of the inner query the cursor refers to and cast is the SQL type
+// the cursor value is compared as.
+type directorySort struct {
+	key        string
+	descending bool
+	cast       string
+	parse      func(string) error
+}
+
+var directorySorts = map[string]directorySort{
+	"newest":    {"created_at", true, "timestamptz", parseTimeKey},
+	"oldest":    {"created_at", false, "timestamptz", parseTimeKey},
+	"posts":     {"post_count", true, "integer", parseIntKey},
+	"relevance": {"score", true, "real", parseFloatKey},
+}
+
+// directoryStatuses are the filters for user managers
+var directoryStatuses = map[string]string{
+	"unverified": "u.email_verified_at IS NULL",
+	"locked": `EXISTS (SELECT 1 FROM login_throttles t
+		WHERE t.key = 'email:' || lower(u.email) AND t.locked_until > CURRENT_TIMESTAMP)`,
+	"pending_deletion": "u.deletion_scheduled_for IS NOT NULL",
+}
+
+// getUsers lists users a page at a time. ?q= matches usernames and display
+// names by prefix or, through trigram similarity, approximately. ?sort= is
+// newest (the default), oldest, posts or, when searching, relevance (the
+// default then). User managers can also filter by ?status= and ?role=.
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("ids") {
+		getUsersByID(w, r)
+		return
+	}
+	claims, authenticated := auth.FromContext(r.Context())
+	manager := authenticated && claims.Can("users:manage")
+
+	limit, err := pagination.Limit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	search := strings.TrimSpace(query.Get("q"))
+	if utf8.RuneCountInString(search) > maxSearchLength {
+		http.Error(w, fmt.Sprintf("q must be at most %d characters", maxSearchLength), http.StatusBadRequest)
+		return
+	}
+	sortName := query.Get("sort")
+	if sortName == "" {
+		sortName = "newest"
+		if search != "" {
+			sortName = "relevance"
+		}
+	}
+	order, ok := directorySorts[sortName]
+	if !ok || (sortName == "relevance" && search == "") {
+		http.Error(w, "sort must be newest, oldest, posts or, with q, relevance", http.StatusBadRequest)
+		return
+	}
+
+	status, role := query.Get("status"), query.Get("role")
+	if (status != "" || role != "") && !manager {
+		http.Error(w, "Filtering by status or role requires users:manage", http.StatusForbidden)
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// Accounts waiting to be purged are hidden unless a manager asks for them
+	if status != "pending_deletion" {
+		conditions = append(conditions, "u.deletion_scheduled_for IS NULL")
+	}
+	if status != "" {
+		condition, ok := directoryStatuses[status]
+		if !ok {
+			http.Error(w, "status must be unverified, locked or pending_deletion", http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, condition)
+	}
+	if role != "" {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM user_roles ur JOIN roles ro ON ro.id = ur.role_id
+			WHERE ur.user_id = u.id AND ro.name = `+arg(role)+`)`)
+	}
+
+	score := "0::real"
+	if search != "" {
+		q, prefix := arg(search), arg(escapeLike(search)+"%")
+		conditions = append(conditions, fmt.Sprintf(
+			"(u.username ILIKE %[2]s OR u.display_name ILIKE %[2]s OR u.username %% %[1]s OR u.display_name %% %[1]s)",
+			q, prefix))
+		// Prefix matches rank above anything that is only similar
+		score = fmt.Sprintf(`(GREATEST(similarity(u.username, %[1]s), similarity(u.display_name, %[1]s))
+			+ CASE WHEN u.username ILIKE %[2]s OR u.display_name ILIKE %[2]s THEN 1 ELSE 0 END)::real`, q, prefix)
+	}
+
+	direction, comparison := "ASC", ">"
+	if order.descending {
+		direction, comparison = "DESC", "<"
+	}
+	after := "TRUE"
+	if cursor := query.Get("cursor"); cursor != "" {
+		key, id, err := pagination.DecodeKeyCursor(cursor)
+		if err == nil {
+			err = order.parse(key)
+		}
+		if err != nil {
+			http.Error(w, pagination.ErrInvalidCursor.Error(), http.StatusBadRequest)
+			return
+		}
+		after = fmt.Sprintf("(%s, id) %s (%s::%s, %s)", order.key, comparison, arg(key), order.cast, arg(id))
+	}
+
+	rows, err := db.Query(
+		`SELECT id, username, display_name, avatar_url, email, show_email, email_verified, post_count, created_at, score
+		FROM (
+			SELECT u.id, u.username, u.display_name, u.avatar_url, u.email, u.show_email,
+				u.email_verified_at IS NOT NULL AS email_verified, u.created_at, u.post_count,
+				`+score+` AS score
+			FROM users u
+			WHERE `+strings.Join(conditions, " AND ")+`
+		) d
+		WHERE `+after+`
+		ORDER BY `+order.key+` `+direction+`, id `+direction+`
+		LIMIT `+arg(limit+1),
+		args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := DirectoryPage{Users: []DirectoryUser{}}
+	var lastKey string
+	for rows.Next() {
+		var u DirectoryUser
+		var showEmail, verified bool
+		var rank float32
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.AvatarURL, &u.Email, &showEmail, &verified,
+			&u.PostCount, &u.CreatedAt, &rank); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if manager {
+			u.EmailVerified = &verified
+		} else if !showEmail {
+			u.Email = ""
+		}
+		if len(page.Users) == limit {
+			// One extra row was fetched to tell whether there is another page
+			last := page.Users[limit-1]
+			page.NextCursor = pagination.EncodeKeyCursor(lastKey, last.ID)
+			break
+		}
+		switch order.key {
+		case "created_at":
+			lastKey = u.CreatedAt.UTC().Format(time.RFC3339Nano)
+		case "post_count":
+			lastKey = strconv.Itoa(u.PostCount)
+		case "score":
+			lastKey = strconv.FormatFloat(float64(rank), 'g', -1, 32)
+		}
+		page.Users = append(page.Users, u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// getUsersByID handles GET /users?ids=1,2,3, returning summaries of the
+// users that exist in no particular order. Post-service and comment-service
+// use it to show authors without one request per user.
+func getUsersByID(w http.ResponseWriter, r *http.Request) {
+	var ids []int64
+	for _, raw := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 32)
+		if err != nil || id < 1 {
+			http.Error(w, "ids must be a comma-separated list of user ids", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > maxBatchIDs {
+		http.Error(w, fmt.Sprintf("At most %d ids can be requested at once", maxBatchIDs), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT id, username, display_name, avatar_url FROM users
+		WHERE id = ANY($1) AND deletion_scheduled_for IS NULL`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var u UserSummary
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.AvatarURL); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]UserSummary{"users": users})
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func parseTimeKey(key string) error {
+	_, err := time.Parse(time.RFC3339Nano, key)
+	return err
+}
+
+func parseIntKey(key string) error {
+	_, err := strconv.Atoi(key)
+	return err
+}
+
+func parseFloatKey(key string) error {
+	_, err := strconv.ParseFloat(key, 32)
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/pagination"
+)
+
+var directoryColumns = []string{"id", "username", "display_name", "avatar_url", "email", "show_email",
+	"email_verified", "post_count", "created_at", "score"}
+
+func TestGetUsers(t *testing.T) {
+	tokens = testTokenConfig()
+	now := time.Now().UTC()
+	rows := [][]driver.Value{
+		{int64(3), "alice", "Alice", "", "alice@example.com", true, true, int64(2), now, 1.5},
+		{int64(2), "alicia", "", "", "alicia@example.com", false, false, int64(0), now.Add(-time.Hour), 0.5},
+		{int64(1), "malice", "", "", "malice@example.com", false, true, int64(9), now.Add(-2 * time.Hour), 0.25},
+	}
+
+	t.Run("search", func(t *testing.T) {
+		fake := useFakeDB(t)
+		fake.OnQuery("FROM users u", directoryColumns, rows...)
+
+		rec := httptest.NewRecorder()
+		authn.OptionalAuth(getUsers)(rec, httptest.NewRequest("GET", "/users?q=ali&limit=2", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+		}
+		var page DirectoryPage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) != 2 || page.Users[0].Email != "alice@example.com" || page.Users[1].Email != "" {
+			t.Errorf("unexpected users %+v", page.Users)
+		}
+		if page.Users[0].EmailVerified != nil {
+			t.Error("verification status shown to anonymous caller")
+		}
+		key, id, err := pagination.DecodeKeyCursor(page.NextCursor)
+		if err != nil || key != "0.5" || id != 2 {
+			t.Errorf("next cursor = %q, %d, %v; want alicia's score", key, id, err)
+		}
+		if !fake.Ran("similarity(") {
+			t.Error("search did not use trigram similarity")
+		}
+	})
+
+	tests := []struct {
+		name        string
+		query       string
+		permissions []string
+		wantStatus  int
+	}{
+		{"newest first", "", nil, http.StatusOK},
+		{"by post count", "?sort=posts", nil, http.StatusOK},
+		{"unknown sort", "?sort=karma", nil, http.StatusBadRequest},
+		{"relevance without a search", "?sort=relevance", nil, http.StatusBadRequest},
+		{"cursor for another sort", "?sort=posts&cursor=" + pagination.EncodeKeyCursor(now.Format(time.RFC3339Nano), 1), nil, http.StatusBadRequest},
+		{"status filter without permission", "?status=locked", nil, http.StatusForbidden},
+		{"role filter without permission", "?role=admin", nil, http.StatusForbidden},
+		{"locked accounts", "?status=locked", []string{"users:manage"}, http.StatusOK},
+		{"unknown status", "?status=sleeping", []string{"users:manage"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("FROM users u", directoryColumns, rows...)
+
+			req := httptest.NewRequest("GET", "/users"+tt.query, nil)
+			if tt.permissions != nil {
+				req.Header.Set("Authorization", bearer(t, 1, tt.permissions...))
+			}
+			rec := httptest.NewRecorder()
+			authn.OptionalAuth(getUsers)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.permissions != nil && tt.wantStatus == http.StatusOK &&
+				!strings.Contains(rec.Body.String(), `"email_verified":false`) {
+				t.Errorf("manager view missing verification status: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetUsersByID(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{"?ids=1,2,3", http.StatusOK},
+		{"?ids=1,,2", http.StatusBadRequest},
+		{"?ids=abc", http.StatusBadRequest},
+		{"?ids=" + strings.TrimSuffix(strings.Repeat("1,", maxBatchIDs+1), ","), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		fake := useFakeDB(t)
+		fake.OnQuery("WHERE id = ANY", []string{"id", "username", "display_name", "avatar_url"},
+			[]driver.Value{int64(1), "john_doe", "John", ""},
+			[]driver.Value{int64(3), "alice", "", "https://cdn.example.com/a.jpg"})
+
+		rec := httptest.NewRecorder()
+		authn.OptionalAuth(getUsers)(rec, httptest.NewRequest("GET", "/users"+tt.query, nil))
+
+		if rec.Code != tt.wantStatus {
+			t.Fatalf("%s: status = %d, want %d (%s)", tt.query, rec.Code, tt.wantStatus, rec.Body.String())
+		}
+		if tt.wantStatus == http.StatusOK && !strings.Contains(rec.Body.String(), `"username":"alice"`) {
+			t.Errorf("unexpected body %s", rec.Body.String())
+		}
+	}
+}
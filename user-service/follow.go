@@ -0,0 +1,202 @@
+// Following other users (follow.go)
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blog-shared/auth"
+	"blog-shared/pagination"
+
+	"github.com/gorilla/mux"
+)
+
+// FollowUser is an entry in a follower or following list
+type FollowUser struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	FollowedAt  time.Time `json:"followed_at"`
+}
+
+// FollowList is one page of a follower or following list
+type FollowList struct {
+	Users      []FollowUser `json:"users"`
+	Total      int          `json:"total"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// FollowCounts are added to profiles returned by getUser
+type FollowCounts struct {
+	Followers int `json:"follower_count"`
+	Following int `json:"following_count"`
+}
+
+// followUser makes the caller follow the user in the URL
+func followUser(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if id == claims.UserID {
+		http.Error(w, "You cannot follow yourself", http.StatusBadRequest)
+		return
+	}
+
+	// Following an account that is being deleted is treated as following
+	// nobody. Blocks do not stop follows, so the blocked user cannot find out
+	// about one by trying to follow; the blocker just never sees the edge.
+	result, err := db.Exec(
+		`INSERT INTO follows (follower_id, followee_id)
+		SELECT $1, id FROM users WHERE id = $2 AND deletion_scheduled_for IS NULL
+		ON CONFLICT DO NOTHING`,
+		claims.UserID, id,
+	)
+	if err != nil {
+		http.Error(w, "Error following user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		err := db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND deletion_scheduled_for IS NULL)", id,
+		).Scan(&exists)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unfollowUser stops the caller following the user in the URL
+func unfollowUser(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	_, err := db.Exec(
+		"DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2",
+		claims.UserID, mux.Vars(r)["id"],
+	)
+	if err != nil {
+		http.Error(w, "Error unfollowing user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getFollowers lists the users following the user in the URL, newest first
+func getFollowers(w http.ResponseWriter, r *http.Request) {
+	writeFollowList(w, r, "followee_id", "follower_id")
+}
+
+// getFollowing lists the users the user in the URL follows, newest first
+func getFollowing(w http.ResponseWriter, r *http.Request) {
+	writeFollowList(w, r, "follower_id", "followee_id")
+}
+
+// writeFollowList pages through follows where matchColumn is the user in the
+// URL, returning the users in listColumn. Users the caller blocked are left
+// out, so only the blocker's view changes.
+func writeFollowList(w http.ResponseWriter, r *http.Request, matchColumn, listColumn string) {
+	id := mux.Vars(r)["id"]
+	viewer := viewerID(r)
+	limit, err := pagination.Limit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The cursor is the position of the last entry on the previous page
+	var before *time.Time
+	var beforeID int
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		key, id, err := pagination.DecodeKeyCursor(cursor)
+		var t time.Time
+		if err == nil {
+			t, err = time.Parse(time.RFC3339Nano, key)
+		}
+		if err != nil {
+			http.Error(w, pagination.ErrInvalidCursor.Error(), http.StatusBadRequest)
+			return
+		}
+		before, beforeID = &t, id
+	}
+
+	list := FollowList{Users: []FollowUser{}}
+	err = db.QueryRow(
+		"SELECT COUNT(*) FROM follows f JOIN users u ON u.id = f."+listColumn+
+			" WHERE f."+matchColumn+" = $1 AND u.deletion_scheduled_for IS NULL AND "+notBlockedBy("$2", "u.id"),
+		id, viewer,
+	).Scan(&list.Total)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT u.id, u.username, u.display_name, u.avatar_url, f.created_at
+		FROM follows f JOIN users u ON u.id = f.`+listColumn+`
+		WHERE f.`+matchColumn+` = $1 AND u.deletion_scheduled_for IS NULL AND `+notBlockedBy("$5", "u.id")+`
+			AND ($2::timestamptz IS NULL OR (f.created_at, f.`+listColumn+`) < ($2, $3))
+		ORDER BY f.created_at DESC, f.`+listColumn+` DESC
+		LIMIT $4`,
+		id, before, beforeID, limit+1, viewer,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u FollowUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.AvatarURL, &u.FollowedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list.Users = append(list.Users, u)
+	}
+	// One extra row was fetched to tell whether there is another page
+	if len(list.Users) > limit {
+		list.Users = list.Users[:limit]
+		last := list.Users[limit-1]
+		list.NextCursor = pagination.EncodeKeyCursor(last.FollowedAt.UTC().Format(time.RFC3339Nano), last.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// followCounts returns how many users follow and are followed by a user, as
+// seen by viewer, who does not count users they blocked
+func followCounts(userID, viewer int) (FollowCounts, error) {
+	var counts FollowCounts
+	err := db.QueryRow(
+		`SELECT
+			(SELECT COUNT(*) FROM follows f JOIN users u ON u.id = f.follower_id
+			WHERE f.followee_id = $1 AND u.deletion_scheduled_for IS NULL AND `+notBlockedBy("$2", "u.id")+`),
+			(SELECT COUNT(*) FROM follows f JOIN users u ON u.id = f.followee_id
+			WHERE f.follower_id = $1 AND u.deletion_scheduled_for IS NULL AND `+notBlockedBy("$2", "u.id")+`)`,
+		userID, viewer,
+	).Scan(&counts.Followers, &counts.Following)
+	return counts, err
+}
+
+// notBlockedBy is a condition that holds unless the user in blocker blocked
+// the user in blocked
+func notBlockedBy(blocker, blocked string) string {
+	return "NOT EXISTS (SELECT 1 FROM user_blocks b WHERE b.blocker_id = " + blocker + " AND b.blocked_id = " + blocked + ")"
+}
+
+// viewerID is the caller's user ID, or 0 for anonymous requests
+func viewerID(r *http.Request) int {
+	if claims, ok := auth.FromContext(r.Context()); ok {
+		return claims.UserID
+	}
+	return 0
+}
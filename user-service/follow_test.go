@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"blog-shared/pagination"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFollowUser(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name       string
+		target     string
+		inserted   int64
+		exists     bool
+		wantStatus int
+	}{
+		{"follow", "2", 1, true, http.StatusNoContent},
+		{"already following", "2", 0, true, http.StatusNoContent},
+		{"unknown user", "99", 0, false, http.StatusNotFound},
+		{"yourself", "1", 0, true, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("INSERT INTO follows", tt.inserted)
+			fake.OnQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{tt.exists})
+
+			req := httptest.NewRequest("POST", "/users/"+tt.target+"/follow", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tt.target})
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(followUser)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			// A blocked user follows like anyone else, so cannot detect the block
+			if fake.Ran("user_blocks") {
+				t.Error("following consulted blocks")
+			}
+		})
+	}
+}
+
+func TestFollowListsHideBlockedUsersFromBlocker(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name       string
+		auth       string
+		wantViewer int64
+	}{
+		// User 1 blocked user 2, who follows them. Only user 1's view drops
+		// user 2; user 2 and everyone else see the follow as before.
+		{"blocker", bearer(t, 1), 1},
+		{"blocked user", bearer(t, 2), 2},
+		{"anonymous", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT COUNT(*)", []string{"count"}, []driver.Value{int64(1)})
+			fake.OnQuery("SELECT u.id", []string{"id", "username", "display_name", "avatar_url", "created_at"},
+				[]driver.Value{int64(2), "bob", "Bob", "", time.Now()})
+
+			req := httptest.NewRequest("GET", "/users/1/followers", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			authn.OptionalAuth(getFollowers)(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+			}
+			if !fake.Ran("b.blocker_id = $2 AND b.blocked_id = u.id") || !fake.Ran("b.blocker_id = $5 AND b.blocked_id = u.id") {
+				t.Fatal("follow list is not filtered by the viewer's blocks")
+			}
+			if args := fake.Args("SELECT COUNT(*)"); len(args) != 2 || args[1] != tt.wantViewer {
+				t.Errorf("total counted for viewer %v, want %d", args, tt.wantViewer)
+			}
+			if args := fake.Args("SELECT u.id"); len(args) != 5 || args[4] != tt.wantViewer {
+				t.Errorf("page listed for viewer %v, want %d", args, tt.wantViewer)
+			}
+		})
+	}
+}
+
+func TestGetFollowersPagination(t *testing.T) {
+	now := time.Now().UTC()
+	fake := useFakeDB(t)
+	fake.OnQuery("SELECT COUNT(*)", []string{"count"}, []driver.Value{int64(3)})
+	fake.OnQuery("SELECT u.id", []string{"id", "username", "display_name", "avatar_url", "created_at"},
+		[]driver.Value{int64(4), "dave", "Dave", "", now},
+		[]driver.Value{int64(3), "carol", "", "", now.Add(-time.Minute)},
+		[]driver.Value{int64(2), "bob", "Bob", "", now.Add(-time.Hour)},
+	)
+
+	req := httptest.NewRequest("GET", "/users/1/followers?limit=2", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rec := httptest.NewRecorder()
+	getFollowers(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	var list FollowList
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 3 || len(list.Users) != 2 || list.Users[1].Username != "carol" {
+		t.Fatalf("unexpected page %+v", list)
+	}
+	key, cursorID, err := pagination.DecodeKeyCursor(list.NextCursor)
+	cursorTime, _ := time.Parse(time.RFC3339Nano, key)
+	if err != nil || cursorID != 3 || !cursorTime.Equal(now.Add(-time.Minute)) {
+		t.Errorf("next cursor = %v, %d, %v; want carol's position", cursorTime, cursorID, err)
+	}
+
+	for _, query := range []string{"?cursor=not-a-cursor", "?limit=0", "?limit=1000"} {
+		req := httptest.NewRequest("GET", "/users/1/followers"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rec := httptest.NewRecorder()
+		getFollowers(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -4,9 +4,14 @@ module blog-service
 go 1.24
 
 require (
+	blog-shared v0.0.0
 	github.com/gorilla/mux v1.8.0
 	github.com/lib/pq v1.10.9
 	golang.org/x/crypto v0.12.0
 )
 
+require golang.org/x/sys v0.13.0 // indirect
+
 // go.sum will be generated when you run go mod download
+
+replace blog-shared => ../shared
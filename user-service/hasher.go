@@ -0,0 +1,223 @@
+// Password hashing (hasher.go)
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errPasswordMismatch is returned by checkPassword for a wrong password
+var errPasswordMismatch = errors.New("password does not match")
+
+// PasswordHasher produces self-describing password hashes, so hashes made
+// with older algorithms or parameters can still be checked and upgraded
+type PasswordHasher interface {
+	// Hash hashes password with the hasher's current parameters
+	Hash(password string) (string, error)
+	// Owns reports whether encoded is in this hasher's format
+	Owns(encoded string) bool
+	// Verify reports whether password matches encoded, which the hasher owns
+	Verify(encoded, password string) (bool, error)
+	// Outdated reports whether encoded should be replaced by a fresh Hash
+	// because it uses another algorithm or other parameters
+	Outdated(encoded string) bool
+}
+
+// passwordHasher hashes new passwords; see loadPasswordHasher
+var passwordHasher PasswordHasher = bcryptHasher{cost: bcrypt.DefaultCost}
+
+// knownHashers can check every format found in the database, whichever one
+// is currently used for new passwords
+var knownHashers = []PasswordHasher{bcryptHasher{}, argon2idHasher{}}
+
+// loadPasswordHasher builds the hasher for new passwords from PASSWORD_HASH
+// (bcrypt or argon2id) and its BCRYPT_* or ARGON2_* settings
+func loadPasswordHasher() (PasswordHasher, error) {
+	switch algorithm := getEnv("PASSWORD_HASH", "bcrypt"); algorithm {
+	case "bcrypt":
+		cost, err := strconv.Atoi(getEnv("BCRYPT_COST", strconv.Itoa(bcrypt.DefaultCost)))
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return bcryptHasher{cost: cost}, nil
+	case "argon2id":
+		var h argon2idHasher
+		for _, setting := range []struct {
+			key      string
+			value    *uint32
+			fallback uint32
+			max      uint32
+		}{
+			{"ARGON2_MEMORY", &h.memory, 64 * 1024, 4 * 1024 * 1024},
+			{"ARGON2_ITERATIONS", &h.iterations, 3, 100},
+			{"ARGON2_PARALLELISM", &h.parallelism, 4, 255},
+		} {
+			value, err := strconv.ParseUint(getEnv(setting.key, strconv.Itoa(int(setting.fallback))), 10, 32)
+			if err != nil || value < 1 || value > uint64(setting.max) {
+				return nil, fmt.Errorf("%s must be between 1 and %d", setting.key, setting.max)
+			}
+			*setting.value = uint32(value)
+		}
+		if h.memory < 8*h.parallelism {
+			return nil, errors.New("ARGON2_MEMORY must be at least 8 KiB per thread")
+		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("PASSWORD_HASH must be bcrypt or argon2id, not %q", algorithm)
+	}
+}
+
+// hashPassword hashes a new password with the current hasher
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// checkPassword returns nil if password matches the stored hash and
+// errPasswordMismatch if it does not. Hashes in no known format, such as
+// the "!" of accounts without a password, never match, but still take as
+// long as a real check.
+func checkPassword(encoded, password string) error {
+	for _, h := range knownHashers {
+		if !h.Owns(encoded) {
+			continue
+		}
+		ok, err := h.Verify(encoded, password)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errPasswordMismatch
+		}
+		return nil
+	}
+	compareDummyPassword(password)
+	return errPasswordMismatch
+}
+
+// rehashPassword replaces an outdated hash after the user has proven the
+// password. It only writes if the hash is unchanged, so a concurrent
+// password change wins. Failures are logged; the old hash still works.
+func rehashPassword(userID int, encoded, password string) {
+	if !passwordHasher.Outdated(encoded) {
+		return
+	}
+	fresh, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Error rehashing password for user %d: %v", userID, err)
+		return
+	}
+	if _, err := db.Exec(
+		"UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3",
+		fresh, userID, encoded,
+	); err != nil {
+		log.Printf("Error rehashing password for user %d: %v", userID, err)
+	}
+}
+
+// bcryptHasher makes $2a$ bcrypt hashes
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hash), err
+}
+
+func (h bcryptHasher) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h bcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h bcryptHasher) Outdated(encoded string) bool {
+	if !h.Owns(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// argon2idHasher makes hashes in the PHC string format used by the
+// reference implementation: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>,
+// where m is the memory in KiB, t the number of passes and p the number
+// of threads
+type argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint32
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, uint8(h.parallelism), argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h argon2idHasher) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, uint8(params.parallelism), uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (h argon2idHasher) Outdated(encoded string) bool {
+	if !h.Owns(encoded) {
+		return true
+	}
+	params, salt, key, err := parseArgon2id(encoded)
+	return err != nil || params != h || len(salt) != argon2SaltLength || len(key) != argon2KeyLength
+}
+
+// parseArgon2id splits an encoded argon2id hash into its parts
+func parseArgon2id(encoded string) (argon2idHasher, []byte, []byte, error) {
+	var params argon2idHasher
+	errInvalid := errors.New("invalid argon2id hash")
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return params, nil, nil, errInvalid
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil ||
+		params.iterations < 1 || params.parallelism < 1 || params.parallelism > 255 {
+		return params, nil, nil, errInvalid
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errInvalid
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id is cheap enough to run in tests
+var testArgon2id = argon2idHasher{memory: 64, iterations: 1, parallelism: 1}
+
+func TestCheckPassword(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"bcrypt":   bcryptHasher{cost: bcrypt.MinCost},
+		"argon2id": testArgon2id,
+	}
+	for name, h := range hashers {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := h.Hash("correct-password1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkPassword(encoded, "correct-password1"); err != nil {
+				t.Errorf("correct password: %v", err)
+			}
+			if err := checkPassword(encoded, "correct-password2"); err != errPasswordMismatch {
+				t.Errorf("wrong password: got %v, want errPasswordMismatch", err)
+			}
+		})
+	}
+
+	// Accounts created through single sign-on have no password
+	if err := checkPassword("!", ""); err != errPasswordMismatch {
+		t.Errorf("placeholder hash: got %v, want errPasswordMismatch", err)
+	}
+	if err := checkPassword("$argon2id$v=19$m=64,t=1,p=1$bad", "x"); err == nil {
+		t.Error("malformed argon2id hash matched")
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	encoded, err := testArgon2id.Hash("correct-password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("encoded = %q", encoded)
+	}
+	params, salt, key, err := parseArgon2id(encoded)
+	if err != nil || params != testArgon2id || len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("parsed %+v, %d byte salt, %d byte key, %v", params, len(salt), len(key), err)
+	}
+}
+
+func TestPasswordHasherOutdated(t *testing.T) {
+	bcrypt4, _ := bcryptHasher{cost: bcrypt.MinCost}.Hash("correct-password1")
+	bcrypt5, _ := bcryptHasher{cost: bcrypt.MinCost + 1}.Hash("correct-password1")
+	argon, _ := testArgon2id.Hash("correct-password1")
+
+	tests := []struct {
+		name     string
+		current  PasswordHasher
+		encoded  string
+		outdated bool
+	}{
+		{"same bcrypt cost", bcryptHasher{cost: bcrypt.MinCost}, bcrypt4, false},
+		{"lower bcrypt cost", bcryptHasher{cost: bcrypt.MinCost + 1}, bcrypt4, true},
+		{"other bcrypt cost", bcryptHasher{cost: bcrypt.MinCost}, bcrypt5, true},
+		{"bcrypt to argon2id", testArgon2id, bcrypt4, true},
+		{"same argon2id parameters", testArgon2id, argon, false},
+		{"other argon2id parameters", argon2idHasher{memory: 128, iterations: 1, parallelism: 1}, argon, true},
+		{"argon2id to bcrypt", bcryptHasher{cost: bcrypt.MinCost}, argon, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.current.Outdated(tt.encoded); got != tt.outdated {
+				t.Errorf("Outdated = %v, want %v", got, tt.outdated)
+			}
+		})
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+	defer func(previous PasswordHasher) { passwordHasher = previous }(passwordHasher)
+	passwordHasher = testArgon2id
+	old, _ := bcryptHasher{cost: bcrypt.MinCost}.Hash("correct-password1")
+
+	fake := useFakeDB(t)
+	fake.OnExec("SET password_hash", 1)
+	rehashPassword(1, old, "correct-password1")
+	if !fake.Ran("SET password_hash") {
+		t.Error("outdated hash was not replaced")
+	}
+
+	current, _ := testArgon2id.Hash("correct-password1")
+	fake = useFakeDB(t)
+	rehashPassword(1, current, "correct-password1")
+	if fake.Ran("SET password_hash") {
+		t.Error("current hash was replaced")
+	}
+}
+
+func TestLoadPasswordHasher(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    PasswordHasher
+		wantErr bool
+	}{
+		{"default", nil, bcryptHasher{cost: bcrypt.DefaultCost}, false},
+		{"bcrypt cost", map[string]string{"BCRYPT_COST": "12"}, bcryptHasher{cost: 12}, false},
+		{"bcrypt cost too low", map[string]string{"BCRYPT_COST": "3"}, nil, true},
+		{"argon2id defaults", map[string]string{"PASSWORD_HASH": "argon2id"}, argon2idHasher{65536, 3, 4}, false},
+		{"argon2id settings", map[string]string{"PASSWORD_HASH": "argon2id", "ARGON2_MEMORY": "19456", "ARGON2_ITERATIONS": "2", "ARGON2_PARALLELISM": "1"},
+			argon2idHasher{19456, 2, 1}, false},
+		{"argon2id too little memory", map[string]string{"PASSWORD_HASH": "argon2id", "ARGON2_MEMORY": "16"}, nil, true},
+		{"unknown algorithm", map[string]string{"PASSWORD_HASH": "md5"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"PASSWORD_HASH", "BCRYPT_COST", "ARGON2_MEMORY", "ARGON2_ITERATIONS", "ARGON2_PARALLELISM"} {
+				t.Setenv(key, tt.env[key])
+			}
+			got, err := loadPasswordHasher()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("hasher = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
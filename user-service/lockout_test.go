@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{8, 8 * time.Minute},
+		{12, time.Hour},
+		{500, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := lockoutDuration(tt.failures, 5); got != tt.want {
+			t.Errorf("lockoutDuration(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginUserLockout(t *testing.T) {
+	tokens = testTokenConfig()
+	now := time.Now()
+	clock = func() time.Time { return now }
+	defer func() { clock = time.Now }()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct-password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userColumns := []string{"id", "username", "email", "email_verified", "password_hash", "created_at", "updated_at"}
+	alice := []driver.Value{int64(7), "alice", "alice@example.com", true, string(hash), now, now}
+
+	tests := []struct {
+		name        string
+		password    string
+		lockedUntil driver.Value
+		user        []driver.Value
+		failures    int64
+		wantStatus  int
+		wantAudit   bool
+	}{
+		{"correct password", "correct-password1", nil, alice, 0, http.StatusOK, false},
+		{"wrong password", "guess-1234", nil, alice, 1, http.StatusUnauthorized, false},
+		{"wrong password reaching threshold", "guess-1234", nil, alice, 5, http.StatusUnauthorized, true},
+		{"unknown email", "guess-1234", nil, nil, 1, http.StatusUnauthorized, false},
+		{"locked out", "correct-password1", now.Add(90 * time.Second), alice, 0, http.StatusTooManyRequests, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("MAX(locked_until)", []string{"locked_until"}, []driver.Value{tt.lockedUntil})
+			if tt.user != nil {
+				fake.OnQuery("FROM users WHERE email", userColumns, tt.user)
+			} else {
+				fake.OnQuery("FROM users WHERE email", userColumns)
+			}
+			fake.OnQuery("INSERT INTO login_throttles", []string{"failures"}, []driver.Value{tt.failures})
+			fake.OnExec("UPDATE login_throttles", 1)
+			fake.OnExec("INSERT INTO security_events", 1)
+			fake.OnExec("DELETE FROM login_throttles", 1)
+			fake.OnExec("SET password_hash", 1)
+			fake.OnQuery("FROM user_totp", []string{"exists"}, []driver.Value{false})
+			fake.OnQuery("array_agg", []string{"roles", "perms"}, []driver.Value{"{author}", "{posts:write}"})
+			fake.OnExec("SET deletion_scheduled_for = NULL", 0)
+			fake.OnQuery("INSERT INTO sessions", []string{"id"}, []driver.Value{int64(11)})
+			fake.OnExec("INSERT INTO refresh_tokens", 1)
+
+			body := `{"email":"alice@example.com","password":"` + tt.password + `"}`
+			rec := httptest.NewRecorder()
+			loginUser(rec, httptest.NewRequest("POST", "/users/login", strings.NewReader(body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusTooManyRequests {
+				if got := rec.Header().Get("Retry-After"); got != "90" {
+					t.Errorf("Retry-After = %q, want 90", got)
+				}
+				if fake.Ran("FROM users") {
+					t.Error("password checked while locked out")
+				}
+			}
+			if fake.Ran("security_events") != tt.wantAudit {
+				t.Errorf("lockout audited = %v, want %v", fake.Ran("security_events"), tt.wantAudit)
+			}
+			if tt.wantStatus == http.StatusOK && !fake.Ran("DELETE FROM login_throttles") {
+				t.Error("failures not cleared after a successful login")
+			}
+		})
+	}
+}
+
+func TestLoginWithoutPasswordTakesDummyTime(t *testing.T) {
+	compared := 0
+	previous := compareDummyPassword
+	compareDummyPassword = func(string) { compared++ }
+	defer func() { compareDummyPassword = previous }()
+
+	now := time.Now()
+	fake := useFakeDB(t)
+	fake.OnQuery("MAX(locked_until)", []string{"locked_until"}, []driver.Value{nil})
+	// SSO-only accounts created by oidc.go have no password hash
+	fake.OnQuery("FROM users WHERE email", []string{"id", "username", "email", "email_verified", "password_hash", "created_at", "updated_at"},
+		[]driver.Value{int64(7), "alice", "alice@example.com", true, "!", now, now})
+	fake.OnQuery("INSERT INTO login_throttles", []string{"failures"}, []driver.Value{int64(1)})
+	fake.OnExec("UPDATE login_throttles", 1)
+
+	body := `{"email":"alice@example.com","password":"guess-1234"}`
+	rec := httptest.NewRecorder()
+	loginUser(rec, httptest.NewRequest("POST", "/users/login", strings.NewReader(body)))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d (%s)", rec.Code, http.StatusUnauthorized, rec.Body.String())
+	}
+	if compared != 1 {
+		t.Errorf("dummy password compared %d times, want 1", compared)
+	}
+}
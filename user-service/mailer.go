@@ -0,0 +1,117 @@
+// Outgoing email (mailer.go)
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email to users
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var mailer Mailer
+
+// newMailer builds the mailer selected by MAILER: "smtp" relays through
+// SMTP_HOST, anything else ("log", the default) writes messages to
+// MAIL_LOG_FILE or the service log.
+func newMailer() (Mailer, error) {
+	from := getEnv("MAIL_FROM", "no-reply@blog.local")
+
+	switch getEnv("MAILER", "log") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST must be set when MAILER=smtp")
+		}
+		return &smtpMailer{
+			addr:     host + ":" + getEnv("SMTP_PORT", "587"),
+			host:     host,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     from,
+		}, nil
+	case "log":
+		return &logMailer{path: os.Getenv("MAIL_LOG_FILE"), from: from}, nil
+	default:
+		return nil, fmt.Errorf("unsupported MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+// formatMessage renders the message as RFC 5322 text
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// smtpMailer relays messages through an SMTP server
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, formatMessage(m.from, msg))
+}
+
+// logMailer appends messages to a file, or to the service log when no file
+// is configured. Useful for development and tests.
+type logMailer struct {
+	mu   sync.Mutex
+	path string
+	from string
+}
+
+func (m *logMailer) Send(msg Message) error {
+	if m.path == "" {
+		log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(formatMessage(m.from, msg)); err != nil {
+		return err
+	}
+	_, err = f.WriteString("\r\n.\r\n")
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpStandIn is a minimal SMTP server that records the messages it accepts
+type smtpStandIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	rcpts    []string
+}
+
+func startSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: l}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *smtpStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP stand-in")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM"):
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO"):
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, strings.TrimSpace(line[len("RCPT TO:"):]))
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := startSMTPStandIn(t)
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+
+	m := &smtpMailer{addr: host + ":" + port, host: host, from: "no-reply@blog.local"}
+	err := m.Send(Message{To: "alice@example.com", Subject: "Hello", Body: "Line one\nLine two"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(server.messages))
+	}
+	if server.rcpts[0] != "<alice@example.com>" {
+		t.Errorf("recipient = %q", server.rcpts[0])
+	}
+	for _, want := range []string{"To: alice@example.com", "Subject: Hello", "Line one\r\nLine two"} {
+		if !strings.Contains(server.messages[0], want) {
+			t.Errorf("message missing %q:\n%s", want, server.messages[0])
+		}
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	m := &smtpMailer{addr: "127.0.0.1:1", host: "127.0.0.1", from: "no-reply@blog.local"}
+	if err := m.Send(Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "x"}); err == nil {
+		t.Error("expected header injection to be rejected")
+	}
+}
+
+func TestLogMailerWritesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	m := &logMailer{path: path, from: "no-reply@blog.local"}
+	if err := m.Send(Message{To: "bob@example.com", Subject: "Reset", Body: "token=abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "To: bob@example.com") || !strings.Contains(string(data), "token=abc") {
+		t.Errorf("unexpected log contents:\n%s", data)
+	}
+}
+
+// recordingMailer keeps sent messages in memory
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (m *recordingMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
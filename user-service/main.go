@@ -8,11 +8,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"blog-shared/auth"
+
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 )
 
 // User represents a user in the system
@@ -23,6 +25,18 @@ type User struct {
 	Password  string    `json:"password"` // Never returned in responses
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// Profile details, see profile.go
+	DisplayName string   `json:"display_name"`
+	Bio         string   `json:"bio"`
+	Links       []string `json:"links"`
+	AvatarURL   string   `json:"avatar_url"`
+	ShowEmail   bool     `json:"show_email"`
+
+	// Loaded at login, never read from or written to JSON
+	EmailVerified bool     `json:"-"`
+	Roles         []string `json:"-"`
+	Permissions   []string `json:"-"`
 }
 
 // UserCredentials is used for login
@@ -31,12 +45,25 @@ type UserCredentials struct {
 	Password string `json:"password"`
 }
 
-// UserResponse is what we return to the client
+// UserResponse is what we return to the client. It is the owner's view of
+// the profile; see PublicUserResponse for what others see.
 type UserResponse struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	DisplayName   string    `json:"display_name"`
+	Bio           string    `json:"bio"`
+	Links         []string  `json:"links"`
+	AvatarURL     string    `json:"avatar_url,omitempty"`
+	ShowEmail     bool      `json:"show_email"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// LoginResponse is returned on successful authentication
+type LoginResponse struct {
+	TokenResponse
+	User UserResponse `json:"user"`
 }
 
 var db *sql.DB
@@ -53,6 +80,39 @@ func main() {
 		dbUser, dbPassword, dbHost, dbPort, dbName)
 
 	var err error
+	tokens, err = loadTokenConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err = newMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordHasher, err = loadPasswordHasher()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	totpKey, err = loadTOTPKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if totpKey == nil {
+		log.Print("TOTP_ENCRYPTION_KEY is not set, two-factor authentication is unavailable")
+	}
+
+	oidcProviders, err = loadOIDCProviders()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err = newStorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	db, err = sql.Open("postgres", connectionString)
 	if err != nil {
 		log.Fatal(err)
@@ -66,6 +126,8 @@ func main() {
 
 	log.Println("Connected to database successfully!")
 
+	go runAccountPurger()
+
 	r := mux.NewRouter()
 
 	r.Use(corsMiddleware)
@@ -76,12 +138,57 @@ func main() {
 
 	r.HandleFunc("/health", healthCheck).Methods("GET")
 	r.HandleFunc("/users", createUser).Methods("POST")
+	r.HandleFunc("/users", authn.OptionalAuth(getUsers)).Methods("GET")
 	r.HandleFunc("/users/login", loginUser).Methods("POST")
-	r.HandleFunc("/users/{id:[0-9]+}", getUser).Methods("GET")
-	r.HandleFunc("/users/{id:[0-9]+}", updateUser).Methods("PUT")
+	r.HandleFunc("/users/login/2fa", loginMFA).Methods("POST")
+	r.HandleFunc("/users/oidc/{provider}/login", oidcLogin).Methods("GET")
+	r.HandleFunc("/users/oidc/{provider}/callback", oidcCallback).Methods("GET")
+	r.HandleFunc("/users/token/refresh", refreshToken).Methods("POST")
+	r.HandleFunc("/users/password/forgot", forgotPassword).Methods("POST")
+	r.HandleFunc("/users/password/reset", resetPassword).Methods("POST")
+	r.HandleFunc("/users/verify", verifyEmail).Methods("GET")
+	r.HandleFunc("/users/verify/resend", authn.RequireAuth(resendVerification)).Methods("POST")
+	r.HandleFunc("/users/by-username/{name}", authn.OptionalAuth(getUserByUsername)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}", authn.OptionalAuth(getUser)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}", authn.RequireAuth(updateUser)).Methods("PUT")
+	r.HandleFunc("/users/{id:[0-9]+}", authn.RequireAuth(deleteUser)).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/follow", authn.RequireAuth(followUser)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/follow", authn.RequireAuth(unfollowUser)).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/followers", authn.OptionalAuth(getFollowers)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/following", authn.OptionalAuth(getFollowing)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/block", authn.RequireAuth(blockUser)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/block", authn.RequireAuth(unblockUser)).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/blocks", authn.RequireAuth(getBlocks)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/mute", authn.RequireAuth(muteUser)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/mute", authn.RequireAuth(unmuteUser)).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/mutes", authn.RequireAuth(getMutes)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/avatar", authn.RequireAuth(uploadAvatar)).Methods("PUT")
+	r.HandleFunc("/users/{id:[0-9]+}/restore", authn.RequireAuth(auth.RequirePermission("users:manage", restoreUser))).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/export", authn.RequireAuth(exportUser)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/password", authn.RequireAuth(changePassword)).Methods("PUT")
+	r.HandleFunc("/users/{id:[0-9]+}/sessions", authn.RequireAuth(getSessions)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/sessions/{sid:[0-9]+}", authn.RequireAuth(deleteSession)).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/2fa/enroll", authn.RequireAuth(enrollTOTP)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/2fa/confirm", authn.RequireAuth(confirmTOTP)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/2fa", authn.RequireAuth(disableTOTP)).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/identities", authn.RequireAuth(getIdentities)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/identities/{provider}", authn.RequireAuth(linkIdentity)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/identities/{provider}", authn.RequireAuth(unlinkIdentity)).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/tokens", authn.RequireAuth(createPersonalToken)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/tokens", authn.RequireAuth(getPersonalTokens)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/tokens/{tokenID:[0-9]+}", authn.RequireAuth(revokePersonalToken)).Methods("DELETE")
+	r.HandleFunc("/roles", authn.RequireAuth(getRoles)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/roles", authn.RequireAuth(getUserRoles)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/roles/{role}", authn.RequireAuth(auth.RequirePermission("users:manage", assignRole))).Methods("PUT")
+	r.HandleFunc("/users/{id:[0-9]+}/roles/{role}", authn.RequireAuth(auth.RequirePermission("users:manage", revokeRole))).Methods("DELETE")
+
+	// Serve uploaded files when they are stored locally
+	if local, ok := storage.(*localStorage); ok {
+		r.PathPrefix(localStoragePath+"/").Handler(local.handler()).Methods("GET", "HEAD")
+	}
 
 	// Start server
-	port := getEnv("PORT", "8090")
+	port := getEnv("PORT", "8081")
 	log.Printf("User service starting on port %s...", port)
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
@@ -137,24 +244,74 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validatePassword(user.Password, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(user.Password)
 	if err != nil {
 		http.Error(w, "Error hashing password", http.StatusInternalServerError)
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error creating user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Names in use or recently given up by someone else cannot be registered
+	available, err := usernameAvailable(tx, user.Username, 0)
+	if err != nil {
+		http.Error(w, "Error creating user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !available {
+		http.Error(w, errUsernameUnavailable.Error(), http.StatusConflict)
+		return
+	}
+
 	// Insert the new user
 	var userID int
-	err = db.QueryRow(
+	err = tx.QueryRow(
 		"INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id",
-		user.Username, user.Email, string(hashedPassword),
+		user.Username, user.Email, hashedPassword,
 	).Scan(&userID)
+	if isUsernameTaken(err) {
+		http.Error(w, errUsernameUnavailable.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error creating user: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Grant the default role to new accounts
+	_, err = tx.Exec(
+		"INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE name = $2",
+		userID, getEnv("DEFAULT_ROLE", "author"),
+	)
+	if err != nil {
+		http.Error(w, "Error assigning role: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error creating user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// New accounts start unverified; the user can ask for another email if
+	// this one fails
+	if token, err := createVerificationToken(userID); err != nil {
+		log.Printf("Error creating verification token for user %d: %v", userID, err)
+	} else {
+		go sendVerificationEmail(userID, user.Email, token)
+	}
+
 	// Return the created user
 	user.ID = userID
 	user.Password = "" // Don't return the password
@@ -179,62 +336,162 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse to check passwords while the account or client is locked out
+	ip := clientIP(r)
+	if err := checkLoginThrottle(creds.Email, ip); err != nil {
+		if locked, ok := err.(errLoginLocked); ok {
+			writeLoginLocked(w, locked)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Find the user by email
 	var user User
 	var hashedPassword string
 	err := db.QueryRow(
-		"SELECT id, username, email, password_hash, created_at, updated_at FROM users WHERE email = $1",
+		"SELECT id, username, email, email_verified_at IS NOT NULL, password_hash, created_at, updated_at FROM users WHERE email = $1",
 		creds.Email,
-	).Scan(&user.ID, &user.Username, &user.Email, &hashedPassword, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &hashedPassword, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check password; unknown emails take the same time as SSO-only accounts
+	// and real passwords, and count as failures
+	if err == sql.ErrNoRows {
+		compareDummyPassword(creds.Password)
+	} else {
+		err = checkPassword(hashedPassword, creds.Password)
+	}
 	if err != nil {
+		if err := recordLoginFailure(creds.Email, ip, user.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if err := clearLoginFailures(creds.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Move hashes made with an older algorithm or cost to the current one
+	rehashPassword(user.ID, hashedPassword, creds.Password)
+
+	// Accounts with two-factor authentication get a challenge instead of tokens
+	enabled, err := totpEnabled(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		startMFAChallenge(w, user)
+		return
+	}
+
+	completeLogin(w, r, user)
+}
 
-	// Check password
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(creds.Password))
+// completeLogin starts a session for an authenticated user and responds
+// with its tokens
+func completeLogin(w http.ResponseWriter, r *http.Request, user User) {
+	// Load the roles to embed in the access token
+	var err error
+	user.Roles, user.Permissions, err = loadGrants(user.ID)
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		http.Error(w, "Error loading roles: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// In a real application, you'd create a JWT token here
-	// For simplicity, we'll just return the user
-	response := UserResponse{
-		ID:        user.ID,
-		Username:  user.Username,
-		Email:     user.Email,
-		CreatedAt: user.CreatedAt,
+	// Signing in during the grace period cancels a pending deletion
+	if _, err := cancelAccountDeletion(user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Start a new session and issue its tokens
+	sessionID, refreshToken, err := createSession(user.ID, r)
+	if err != nil {
+		http.Error(w, "Error creating session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, err := tokens.issueAccessToken(user, sessionID)
+	if err != nil {
+		http.Error(w, "Error issuing token", http.StatusInternalServerError)
+		return
+	}
+
+	response := LoginResponse{
+		TokenResponse: TokenResponse{
+			AccessToken:      accessToken,
+			TokenType:        "Bearer",
+			ExpiresIn:        int(tokens.accessTTL.Seconds()),
+			RefreshToken:     refreshToken,
+			RefreshExpiresIn: int(tokens.refreshTTL.Seconds()),
+		},
+		User: UserResponse{
+			ID:            user.ID,
+			Username:      user.Username,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			CreatedAt:     user.CreatedAt,
+		},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	json.NewEncoder(w).Encode(response)
 }
 
-// getUser returns a user's profile
+// getUser returns a user's profile. The user and holders of users:manage
+// see the private view; everyone else sees the public one.
 func getUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var user User
-	err := db.QueryRow(
-		"SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1",
+	user, err := scanUserProfile(db.QueryRow(
+		"SELECT "+userProfileColumns+" FROM users WHERE id = $1 AND deletion_scheduled_for IS NULL",
 		id,
-	).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
-	if err != nil {
+	))
+	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	response := UserResponse{
-		ID:        user.ID,
-		Username:  user.Username,
-		Email:     user.Email,
-		CreatedAt: user.CreatedAt,
+	writeUserProfile(w, r, user)
+}
+
+// writeUserProfile responds with the view of a profile the caller may see,
+// along with the user's follow counts
+func writeUserProfile(w http.ResponseWriter, r *http.Request, user User) {
+	counts, err := followCounts(user.ID, viewerID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	claims, ok := auth.FromContext(r.Context())
+	if ok && (claims.UserID == user.ID || claims.Can("users:manage")) {
+		json.NewEncoder(w).Encode(struct {
+			UserResponse
+			FollowCounts
+		}{newUserResponse(user), counts})
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		PublicUserResponse
+		FollowCounts
+	}{newPublicUserResponse(user), counts})
 }
 
 // updateUser updates a user's profile
@@ -242,39 +499,102 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	// Only the user themselves or a user manager may change a profile
+	if !authorizeSelf(w, r, id) {
+		return
+	}
+
+	var req UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateProfile(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var links interface{}
+	if req.Links != nil {
+		links = pq.Array(*req.Links)
+	}
 
-	// Update the user
-	_, err := db.Exec(
-		"UPDATE users SET username = $1, email = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
-		user.Username, user.Email, id,
-	)
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, "Error updating user: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	// Renames keep the old name reserved; user managers are not rate limited
+	if req.Username != nil {
+		claims, _ := auth.FromContext(r.Context())
+		userID, _ := strconv.Atoi(id)
+		if err := changeUsername(tx, userID, *req.Username, !claims.Can("users:manage")); err != nil {
+			writeUsernameError(w, err)
+			return
+		}
+	}
+
+	// Update the user. A new email address has to be verified again.
+	var emailChanged bool
+	err = tx.QueryRow(
+		`UPDATE users u SET
+			username = COALESCE($1, u.username),
+			email = COALESCE($2, u.email),
+			email_verified_at = CASE WHEN u.email = COALESCE($2, u.email) THEN u.email_verified_at END,
+			display_name = COALESCE($3, u.display_name),
+			bio = COALESCE($4, u.bio),
+			links = COALESCE($5, u.links),
+			avatar_url = COALESCE($6, u.avatar_url),
+			show_email = COALESCE($7, u.show_email),
+			updated_at = CURRENT_TIMESTAMP
+		FROM users old WHERE u.id = $8 AND old.id = u.id
+		RETURNING old.email <> u.email`,
+		req.Username, req.Email, req.DisplayName, req.Bio, links, req.AvatarURL, req.ShowEmail, id,
+	).Scan(&emailChanged)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if isUsernameTaken(err) {
+		http.Error(w, errUsernameUnavailable.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error updating user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error updating user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Get the updated user
-	err = db.QueryRow(
-		"SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1",
-		id,
-	).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	user, err := scanUserProfile(db.QueryRow("SELECT "+userProfileColumns+" FROM users WHERE id = $1", id))
 	if err != nil {
 		http.Error(w, "User not found after update", http.StatusInternalServerError)
 		return
 	}
 
-	response := UserResponse{
-		ID:        user.ID,
-		Username:  user.Username,
-		Email:     user.Email,
-		CreatedAt: user.CreatedAt,
+	if emailChanged {
+		if token, err := createVerificationToken(user.ID); err != nil {
+			log.Printf("Error creating verification token for user %d: %v", user.ID, err)
+		} else {
+			go sendVerificationEmail(user.ID, user.Email, token)
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(newUserResponse(user))
+}
+
+// authorizeSelf writes a 403 response unless the caller is the user with the
+// given ID or may manage users
+func authorizeSelf(w http.ResponseWriter, r *http.Request, id string) bool {
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != id && !claims.Can("users:manage") {
+		http.Error(w, "You do not have permission to modify this user", http.StatusForbidden)
+		return false
+	}
+	return true
 }
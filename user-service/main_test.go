@@ -1,7 +1,169 @@
 package main
 
-import "testing"
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+	"blog-shared/fakedb"
+
+	"github.com/gorilla/mux"
+)
 
 func TestHealthCheck(t *testing.T) {
-	_ = 2
+	rec := httptest.NewRecorder()
+	healthCheck(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// useFakeDB points db at a scripted fake for the duration of the test
+func useFakeDB(t *testing.T) *fakedb.DB {
+	t.Helper()
+	return fakedb.Use(t, &db)
+}
+
+// bearer returns an Authorization header value granting the given permissions
+func bearer(t *testing.T, userID int, permissions ...string) string {
+	t.Helper()
+	token, err := tokens.sign(auth.Claims{
+		Subject:     strconv.Itoa(userID),
+		Issuer:      tokens.issuer,
+		IssuedAt:    time.Now().Unix(),
+		ExpiresAt:   time.Now().Add(time.Minute).Unix(),
+		UserID:      userID,
+		Username:    "user",
+		Permissions: permissions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+var profileColumns = []string{"id", "username", "email", "email_verified",
+	"display_name", "bio", "links", "avatar_url", "show_email", "created_at", "updated_at"}
+
+// profileRow is alice's row as selected with userProfileColumns
+func profileRow(id int64, showEmail bool) []driver.Value {
+	now := time.Now()
+	return []driver.Value{id, "alice", "alice@example.com", true,
+		"Alice", "Writes about Go", "{https://alice.dev}", "", showEmail, now, now}
+}
+
+func TestUpdateUserAuthorization(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name       string
+		auth       string
+		wantStatus int
+	}{
+		{"without token", "", http.StatusUnauthorized},
+		{"by same user", bearer(t, 1), http.StatusOK},
+		{"by other user", bearer(t, 2), http.StatusForbidden},
+		{"by comment moderator", bearer(t, 2, "comments:moderate"), http.StatusForbidden},
+		{"by user manager", bearer(t, 3, "users:manage"), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("FOR UPDATE", []string{"username"}, []driver.Value{"alice"})
+			fake.OnQuery("UPDATE users", []string{"email_changed"}, []driver.Value{false})
+			fake.OnQuery("SELECT id, username, email", profileColumns, profileRow(1, false))
+
+			req := httptest.NewRequest("PUT", "/users/1", strings.NewReader(`{"username":"alice","email":"alice@example.com"}`))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(updateUser)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if ran := fake.Ran("UPDATE users"); ran != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("ran UPDATE users = %v", ran)
+			}
+		})
+	}
+}
+
+func TestGetUserVisibility(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name      string
+		auth      string
+		showEmail bool
+		wantEmail bool
+	}{
+		{"anonymous, email hidden", "", false, false},
+		{"anonymous, email shown", "", true, true},
+		{"other user", bearer(t, 2), false, false},
+		{"owner", bearer(t, 1), false, true},
+		{"user manager", bearer(t, 3, "users:manage"), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("FROM users WHERE id", profileColumns, profileRow(1, tt.showEmail))
+			fake.OnQuery("FROM follows", []string{"followers", "following"}, []driver.Value{int64(3), int64(4)})
+
+			req := httptest.NewRequest("GET", "/users/1", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			authn.OptionalAuth(getUser)(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d (%s)", rec.Code, rec.Body.String())
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, "alice@example.com"); got != tt.wantEmail {
+				t.Errorf("email shown = %v, want %v: %s", got, tt.wantEmail, body)
+			}
+			if !strings.Contains(body, `"display_name":"Alice"`) || !strings.Contains(body, "https://alice.dev") ||
+				!strings.Contains(body, `"follower_count":3`) {
+				t.Errorf("profile fields missing: %s", body)
+			}
+		})
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	str := func(s string) *string { return &s }
+	links := func(l ...string) *[]string { return &l }
+
+	tests := []struct {
+		name  string
+		req   UpdateUserRequest
+		valid bool
+	}{
+		{"empty update", UpdateUserRequest{}, true},
+		{"full profile", UpdateUserRequest{DisplayName: str("Alice"), Bio: str("Hi"), Links: links("https://alice.dev"), AvatarURL: str("https://cdn.example.com/a.png")}, true},
+		{"clear avatar", UpdateUserRequest{AvatarURL: str("")}, true},
+		{"blank username", UpdateUserRequest{Username: str("  ")}, false},
+		{"long bio", UpdateUserRequest{Bio: str(strings.Repeat("x", maxBioLength+1))}, false},
+		{"javascript link", UpdateUserRequest{Links: links("javascript:alert(1)")}, false},
+		{"relative link", UpdateUserRequest{Links: links("/about")}, false},
+		{"too many links", UpdateUserRequest{Links: links("https://a.dev", "https://b.dev", "https://c.dev", "https://d.dev", "https://e.dev", "https://f.dev")}, false},
+	}
+
+	for _, tt := range tests {
+		if err := validateProfile(&tt.req); (err == nil) != tt.valid {
+			t.Errorf("%s: validateProfile = %v, want valid=%v", tt.name, err, tt.valid)
+		}
+	}
 }
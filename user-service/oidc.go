@@ -0,0 +1,713 @@
+// OpenID Connect login (oidc.go)
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// oidcProvider is an external identity provider configured through
+// OIDC_<NAME>_* environment variables
+type oidcProvider struct {
+	name         string
+	issuer       string
+	clientID     string
+	clientSecret string
+	scopes       string
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// oidcDiscovery is the subset of the provider's discovery document we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// idTokenClaims are the ID token claims used to find or create the user
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	ExpiresAt         int64    `json:"exp"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// audience accepts the aud claim as either a string or an array
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// Identity is an external account linked to a user
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	oidcProviders  = map[string]*oidcProvider{}
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+	errIdentityConflict = errors.New("An account with this email already exists; log in and link this provider from your account instead")
+)
+
+// loadOIDCProviders reads OIDC_PROVIDERS, a comma-separated list of names,
+// and the OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and _SCOPES settings
+// for each
+func loadOIDCProviders() (map[string]*oidcProvider, error) {
+	providers := map[string]*oidcProvider{}
+	for _, name := range strings.Split(getEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			name:         name,
+			issuer:       strings.TrimSuffix(getEnv(prefix+"ISSUER", ""), "/"),
+			clientID:     getEnv(prefix+"CLIENT_ID", ""),
+			clientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			scopes:       getEnv(prefix+"SCOPES", "openid email profile"),
+		}
+		if p.issuer == "" || p.clientID == "" {
+			return nil, fmt.Errorf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+		}
+		providers[name] = p
+	}
+	return providers, nil
+}
+
+// redirectURI is where the provider sends the user back to
+func (p *oidcProvider) redirectURI() string {
+	return getEnv("PUBLIC_API_URL", "http://localhost:8081") + "/users/oidc/" + p.name + "/callback"
+}
+
+// getDiscovery fetches and caches the provider's discovery document
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := getJSON(p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("incomplete or mismatched discovery document")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// signingKey returns the provider's RSA key with the given id, refetching
+// the key set when the id is unknown so that key rotation is picked up
+func (p *oidcProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+// getJSON fetches a URL and decodes the JSON response
+func getJSON(rawURL string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// exchangeCode redeems an authorization code and returns the ID token
+func (p *oidcProvider) exchangeCode(code, verifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURI())
+	form.Set("client_id", p.clientID)
+	form.Set("code_verifier", verifier)
+	if p.clientSecret != "" {
+		form.Set("client_secret", p.clientSecret)
+	}
+
+	resp, err := oidcHTTPClient.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's RS256 signature, issuer, audience,
+// expiry and nonce
+func (p *oidcProvider) verifyIDToken(token, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, auth.ErrInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "RS256" {
+		return nil, auth.ErrInvalidToken
+	}
+
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+
+	audienceOK := false
+	for _, aud := range claims.Audience {
+		if aud == p.clientID {
+			audienceOK = true
+		}
+	}
+	if claims.Issuer != p.issuer || !audienceOK || claims.Subject == "" || claims.Nonce != nonce {
+		return nil, auth.ErrInvalidToken
+	}
+	if clock().Unix() >= claims.ExpiresAt {
+		return nil, auth.ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// randomURLString returns n random bytes encoded for use in URLs
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// authorizationURL records a new login attempt and returns the provider URL
+// to send the browser to. linkUserID is set when an existing user is linking
+// the provider to their account.
+func (p *oidcProvider) authorizationURL(linkUserID int) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	state, stateHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomURLString(16)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", err
+	}
+
+	var linkUser sql.NullInt64
+	if linkUserID != 0 {
+		linkUser = sql.NullInt64{Int64: int64(linkUserID), Valid: true}
+	}
+	_, err = db.Exec(
+		`INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, link_user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		stateHash, p.name, nonce, verifier, linkUser, clock().Add(oidcStateTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientID)
+	params.Set("redirect_uri", p.redirectURI())
+	params.Set("scope", p.scopes)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return d.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// providerFromRequest looks up the provider named in the URL, writing a 404
+// if it is not configured
+func providerFromRequest(w http.ResponseWriter, r *http.Request) (*oidcProvider, bool) {
+	p, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+	}
+	return p, ok
+}
+
+// oidcLogin redirects the browser to the identity provider
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := providerFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	authURL, err := p.authorizationURL(0)
+	if err != nil {
+		http.Error(w, "Error contacting identity provider: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// linkIdentity starts linking an identity provider to the caller's account
+// and returns the URL to send the browser to
+func linkIdentity(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != mux.Vars(r)["id"] {
+		http.Error(w, "You can only link identities to your own account", http.StatusForbidden)
+		return
+	}
+	p, ok := providerFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	authURL, err := p.authorizationURL(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error contacting identity provider: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"authorization_url": authURL})
+}
+
+// oidcCallback finishes the authorization code flow: it checks the state,
+// redeems the code, verifies the ID token and logs in the linked user,
+// creating an account on first sign-in
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	p, ok := providerFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, "Identity provider returned an error: "+errCode, http.StatusUnauthorized)
+		return
+	}
+	if query.Get("state") == "" || query.Get("code") == "" {
+		http.Error(w, "state and code are required", http.StatusBadRequest)
+		return
+	}
+
+	// States are single-use, so delete it as it is read
+	var nonce, verifier string
+	var linkUser sql.NullInt64
+	var expiresAt time.Time
+	err := db.QueryRow(
+		`DELETE FROM oidc_login_states WHERE state_hash = $1 AND provider = $2
+		RETURNING nonce, code_verifier, link_user_id, expires_at`,
+		hashToken(query.Get("state")), p.name,
+	).Scan(&nonce, &verifier, &linkUser, &expiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || clock().After(expiresAt) {
+		http.Error(w, "Invalid or expired login attempt, please start again", http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := p.exchangeCode(query.Get("code"), verifier)
+	if err != nil {
+		http.Error(w, "Error redeeming authorization code: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	idClaims, err := p.verifyIDToken(idToken, nonce)
+	if err != nil {
+		http.Error(w, "Invalid ID token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if linkUser.Valid {
+		if err := addIdentity(int(linkUser.Int64), p.name, idClaims); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Identity linked"})
+		return
+	}
+
+	user, err := userForIdentity(p.name, idClaims)
+	if err == errIdentityConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error signing in: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Local two-factor authentication still applies
+	enabled, err := totpEnabled(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		startMFAChallenge(w, user)
+		return
+	}
+
+	completeLogin(w, r, user)
+}
+
+// addIdentity links an external identity to an existing user
+func addIdentity(userID int, provider string, claims *idTokenClaims) error {
+	result, err := db.Exec(
+		`INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, subject) DO NOTHING`,
+		userID, provider, claims.Subject, claims.Email,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return errors.New("This identity is already linked to an account")
+	}
+	return recordSecurityEvent(sql.NullInt64{Int64: int64(userID), Valid: true}, "identity_linked", "", provider)
+}
+
+// userForIdentity returns the user linked to an external identity. On first
+// sign-in it links the identity to the account with the same email when
+// both the provider and the account have verified that address, and
+// otherwise creates a new account.
+func userForIdentity(provider string, claims *idTokenClaims) (User, error) {
+	var user User
+	err := db.QueryRow(
+		`SELECT u.id, u.username, u.email, u.email_verified_at IS NOT NULL, u.created_at, u.updated_at
+		FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider = $1 AND i.subject = $2`,
+		provider, claims.Subject,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.CreatedAt, &user.UpdatedAt)
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	if claims.Email == "" {
+		return user, errors.New("the identity provider did not share an email address")
+	}
+
+	err = db.QueryRow(
+		"SELECT id, username, email, email_verified_at IS NOT NULL, created_at, updated_at FROM users WHERE email = $1",
+		claims.Email,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.CreatedAt, &user.UpdatedAt)
+	if err == nil {
+		// Linking by email is only safe when both sides have proven ownership
+		if !claims.EmailVerified || !user.EmailVerified {
+			return user, errIdentityConflict
+		}
+		return user, addIdentity(user.ID, provider, claims)
+	}
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	return createIdentityUser(provider, claims)
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// createIdentityUser creates an account for a first-time external sign-in.
+// The account has no usable password until the user resets it.
+func createIdentityUser(provider string, claims *idTokenClaims) (User, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = strings.Trim(usernameUnsafe.ReplaceAllString(strings.ToLower(base), "_"), "_")
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	// Pick a free username, adding a random suffix if the preferred one is taken
+	username := base
+	for attempt := 0; ; attempt++ {
+		available, err := usernameAvailable(tx, username, 0)
+		if err != nil {
+			return User{}, err
+		}
+		if available {
+			break
+		}
+		if attempt == 5 {
+			return User{}, errors.New("could not find a free username")
+		}
+		suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return User{}, err
+		}
+		username = fmt.Sprintf("%s_%04d", base, suffix)
+	}
+
+	user := User{Username: username, Email: claims.Email, EmailVerified: claims.EmailVerified}
+	var verifiedAt sql.NullTime
+	if claims.EmailVerified {
+		verifiedAt = sql.NullTime{Time: clock(), Valid: true}
+	}
+	// "!" is in no password hash format, so password login is impossible
+	err = tx.QueryRow(
+		`INSERT INTO users (username, email, password_hash, email_verified_at) VALUES ($1, $2, '!', $3)
+		RETURNING id, created_at, updated_at`,
+		user.Username, user.Email, verifiedAt,
+	).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE name = $2",
+		user.ID, getEnv("DEFAULT_ROLE", "author"),
+	)
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)",
+		user.ID, provider, claims.Subject, claims.Email,
+	)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, tx.Commit()
+}
+
+// getIdentities lists the external identities linked to the caller's account
+func getIdentities(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != mux.Vars(r)["id"] {
+		http.Error(w, "You can only view your own identities", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT provider, subject, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at",
+		claims.UserID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var i Identity
+		var email sql.NullString
+		if err := rows.Scan(&i.Provider, &i.Subject, &email, &i.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		i.Email = email.String
+		identities = append(identities, i)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identities)
+}
+
+// unlinkIdentity removes a linked identity from the caller's account. The
+// last identity of an account without a password is kept, since nothing
+// else could sign in to it.
+func unlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	vars := mux.Vars(r)
+	if strconv.Itoa(claims.UserID) != vars["id"] {
+		http.Error(w, "You can only unlink your own identities", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The user row lock keeps two unlinks from each leaving the other one
+	var noPassword bool
+	var identities int
+	err = tx.QueryRow(
+		`SELECT password_hash = '!', (SELECT COUNT(*) FROM user_identities WHERE user_id = users.id)
+		FROM users WHERE id = $1 FOR UPDATE`,
+		claims.UserID,
+	).Scan(&noPassword, &identities)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM user_identities WHERE user_id = $1 AND provider = $2", claims.UserID, vars["provider"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	if noPassword && identities <= 1 {
+		http.Error(w, "Set a password before unlinking your last identity", http.StatusConflict)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
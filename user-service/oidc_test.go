@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// mockOIDCServer is a minimal identity provider that issues whatever ID
+// token claims the test sets
+type mockOIDCServer struct {
+	*httptest.Server
+	key          *rsa.PrivateKey
+	claims       map[string]interface{}
+	wantVerifier string
+}
+
+func startMockOIDCServer(t *testing.T) *mockOIDCServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDCServer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "auth-code" || r.PostFormValue("code_verifier") != m.wantVerifier {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, m.claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockOIDCServer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test-key"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCLoginRedirect(t *testing.T) {
+	server := startMockOIDCServer(t)
+	oidcProviders = map[string]*oidcProvider{"mock": {name: "mock", issuer: server.URL, clientID: "blog", scopes: "openid email"}}
+	fake := useFakeDB(t)
+	fake.OnExec("INSERT INTO oidc_login_states", 1)
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/users/oidc/mock/login", nil), map[string]string{"provider": "mock"})
+	rec := httptest.NewRecorder()
+	oidcLogin(rec, req)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d (%s)", rec.Code, http.StatusFound, rec.Body.String())
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := location.Query()
+	if location.Path != "/authorize" || params.Get("client_id") != "blog" || params.Get("code_challenge_method") != "S256" {
+		t.Errorf("unexpected authorization URL %s", location)
+	}
+	for _, p := range []string{"state", "nonce", "code_challenge"} {
+		if params.Get(p) == "" {
+			t.Errorf("authorization URL missing %s", p)
+		}
+	}
+	if !fake.Ran("INSERT INTO oidc_login_states") {
+		t.Error("login state was not stored")
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	tokens = testTokenConfig()
+	server := startMockOIDCServer(t)
+	server.wantVerifier = "verifier-123"
+	oidcProviders = map[string]*oidcProvider{"mock": {name: "mock", issuer: server.URL, clientID: "blog"}}
+
+	now := time.Now()
+	stateColumns := []string{"nonce", "code_verifier", "link_user_id", "expires_at"}
+	validState := []driver.Value{"nonce-abc", "verifier-123", nil, now.Add(time.Minute)}
+	userColumns := []string{"id", "username", "email", "email_verified", "created_at", "updated_at"}
+	alice := []driver.Value{int64(7), "alice", "alice@example.com", true, now, now}
+	unverifiedAlice := []driver.Value{int64(7), "alice", "alice@example.com", false, now, now}
+
+	idClaims := func(nonce string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": server.URL, "aud": "blog", "sub": "ext-42", "exp": now.Add(time.Minute).Unix(),
+			"nonce": nonce, "email": "alice@example.com", "email_verified": true, "preferred_username": "Alice",
+		}
+	}
+
+	tests := []struct {
+		name        string
+		state       []driver.Value
+		claims      map[string]interface{}
+		linked      []driver.Value
+		byEmail     []driver.Value
+		wantStatus  int
+		wantCreated bool
+	}{
+		{"linked identity", validState, idClaims("nonce-abc"), alice, nil, http.StatusOK, false},
+		{"verified email links existing account", validState, idClaims("nonce-abc"), nil, alice, http.StatusOK, false},
+		{"unverified account is not linked", validState, idClaims("nonce-abc"), nil, unverifiedAlice, http.StatusConflict, false},
+		{"first sign-in creates account", validState, idClaims("nonce-abc"), nil, nil, http.StatusOK, true},
+		{"nonce mismatch", validState, idClaims("other-nonce"), alice, nil, http.StatusUnauthorized, false},
+		{"unknown state", nil, idClaims("nonce-abc"), alice, nil, http.StatusBadRequest, false},
+		{"expired state", []driver.Value{"nonce-abc", "verifier-123", nil, now.Add(-time.Second)}, idClaims("nonce-abc"), alice, nil, http.StatusBadRequest, false},
+		{"wrong code verifier", []driver.Value{"nonce-abc", "other-verifier", nil, now.Add(time.Minute)}, idClaims("nonce-abc"), alice, nil, http.StatusBadGateway, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.claims = tt.claims
+			fake := useFakeDB(t)
+			rows := func(row []driver.Value) [][]driver.Value {
+				if row == nil {
+					return nil
+				}
+				return [][]driver.Value{row}
+			}
+			fake.OnQuery("DELETE FROM oidc_login_states", stateColumns, rows(tt.state)...)
+			fake.OnQuery("FROM user_identities i", userColumns, rows(tt.linked)...)
+			fake.OnQuery("FROM users WHERE email", userColumns, rows(tt.byEmail)...)
+			fake.OnQuery("FROM username_history", []string{"available"}, []driver.Value{true})
+			fake.OnQuery("INSERT INTO users", []string{"id", "created_at", "updated_at"}, []driver.Value{int64(8), now, now})
+			fake.OnExec("INSERT INTO user_roles", 1)
+			fake.OnExec("INSERT INTO user_identities", 1)
+			fake.OnExec("INSERT INTO security_events", 1)
+			fake.OnQuery("FROM user_totp", []string{"exists"}, []driver.Value{false})
+			fake.OnQuery("array_agg", []string{"roles", "perms"}, []driver.Value{"{author}", "{posts:write}"})
+			fake.OnExec("SET deletion_scheduled_for = NULL", 0)
+			fake.OnQuery("INSERT INTO sessions", []string{"id"}, []driver.Value{int64(11)})
+			fake.OnExec("INSERT INTO refresh_tokens", 1)
+
+			req := httptest.NewRequest("GET", "/users/oidc/mock/callback?code=auth-code&state=xyz", nil)
+			req = mux.SetURLVars(req, map[string]string{"provider": "mock"})
+			rec := httptest.NewRecorder()
+			oidcCallback(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if fake.Ran("INSERT INTO users") != tt.wantCreated {
+				t.Errorf("account created = %v, want %v", fake.Ran("INSERT INTO users"), tt.wantCreated)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var response LoginResponse
+				if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || response.AccessToken == "" {
+					t.Errorf("expected login response, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name       string
+		noPassword bool
+		identities int64
+		deleted    int64
+		wantStatus int
+	}{
+		{"with a password", false, 1, 1, http.StatusNoContent},
+		{"one of several identities", true, 2, 1, http.StatusNoContent},
+		{"last identity without a password", true, 1, 1, http.StatusConflict},
+		{"not linked", true, 1, 0, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("FOR UPDATE", []string{"no_password", "identities"}, []driver.Value{tt.noPassword, tt.identities})
+			fake.OnExec("DELETE FROM user_identities", tt.deleted)
+
+			req := httptest.NewRequest("DELETE", "/users/1/identities/mock", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "1", "provider": "mock"})
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(unlinkIdentity)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
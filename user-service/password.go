@@ -0,0 +1,345 @@
+// Password policy, changes and recovery (password.go)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+// ChangePasswordRequest is used by a logged-in user to change their password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ForgotPasswordRequest starts a password reset
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest completes a password reset
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// validatePassword checks a new password against the password policy
+func validatePassword(password string, user User) error {
+	minLength, err := strconv.Atoi(getEnv("PASSWORD_MIN_LENGTH", "8"))
+	if err != nil || minLength < 8 {
+		minLength = 8
+	}
+
+	if utf8.RuneCountInString(password) < minLength {
+		return fmt.Errorf("Password must be at least %d characters", minLength)
+	}
+	// bcrypt ignores everything after 72 bytes
+	if len(password) > 72 {
+		return errors.New("Password must be at most 72 bytes")
+	}
+
+	var hasLetter, hasOther bool
+	for _, c := range password {
+		if unicode.IsLetter(c) {
+			hasLetter = true
+		} else if !unicode.IsSpace(c) {
+			hasOther = true
+		}
+	}
+	if !hasLetter || !hasOther {
+		return errors.New("Password must contain a letter and a number or symbol")
+	}
+
+	lower := strings.ToLower(password)
+	if user.Username != "" && strings.Contains(lower, strings.ToLower(user.Username)) {
+		return errors.New("Password must not contain your username")
+	}
+	if local, _, ok := strings.Cut(user.Email, "@"); ok && len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+		return errors.New("Password must not contain your email address")
+	}
+	return nil
+}
+
+// changePassword sets a new password for the caller after checking the
+// current one, then signs out every other session
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	claims, _ := auth.FromContext(r.Context())
+
+	// Knowing the current password is required, so this is never done on
+	// someone else's behalf
+	if strconv.Itoa(claims.UserID) != id {
+		http.Error(w, "You can only change your own password", http.StatusForbidden)
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, "Current and new passwords are required", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	var hashedPassword string
+	err := db.QueryRow(
+		"SELECT id, username, email, password_hash FROM users WHERE id = $1",
+		claims.UserID,
+	).Scan(&user.ID, &user.Username, &user.Email, &hashedPassword)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if checkPassword(hashedPassword, req.CurrentPassword) != nil {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		http.Error(w, "New password must be different from the current password", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.NewPassword, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		newHash, user.ID,
+	)
+	if err != nil {
+		http.Error(w, "Error updating password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Keep the current session, sign out everything else
+	_, err = tx.Exec(
+		"UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = 'password_change' WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL",
+		user.ID, claims.SessionID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Outstanding reset links would let someone undo the change
+	if _, err = tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = $1 AND used_at IS NULL", user.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forgotPassword emails a single-use reset link. The response is the same
+// whether or not the email belongs to an account.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE email = $1", req.Email).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Create and send the token in the background so the response time does
+	// not reveal whether the account exists
+	if err == nil {
+		go sendPasswordReset(userID, req.Email)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account exists for that email, a reset link has been sent",
+	})
+}
+
+// sendPasswordReset issues a reset token and emails it to the user
+func sendPasswordReset(userID int, email string) {
+	token, err := createPasswordResetToken(userID)
+	if err != nil {
+		log.Printf("Error creating password reset token for user %d: %v", userID, err)
+		return
+	}
+
+	msg := Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for your account.\n\n"+
+				"Use this link within %s to choose a new password:\n\n%s/reset-password?token=%s\n\n"+
+				"If this wasn't you, you can ignore this email.\n",
+			passwordResetTTL(), getEnv("APP_BASE_URL", "http://localhost:8080"), token,
+		),
+	}
+	if err := mailer.Send(msg); err != nil {
+		log.Printf("Error sending password reset email to user %d: %v", userID, err)
+	}
+}
+
+// passwordResetTTL returns how long reset tokens stay valid
+func passwordResetTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("PASSWORD_RESET_TTL", "1h"))
+	if err != nil {
+		return time.Hour
+	}
+	return ttl
+}
+
+// createPasswordResetToken replaces any outstanding reset tokens for the user
+// with a new one and returns it
+func createPasswordResetToken(userID int) (string, error) {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = $1 AND used_at IS NULL", userID)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID, hash, time.Now().Add(passwordResetTTL()),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// resetPassword sets a new password using a reset token
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		http.Error(w, "Token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var tokenID int
+	var user User
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(
+		`SELECT t.id, t.expires_at, t.used_at, u.id, u.username, u.email
+		FROM password_reset_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 FOR UPDATE OF t`,
+		hashToken(req.Token),
+	).Scan(&tokenID, &expiresAt, &usedAt, &user.ID, &user.Username, &user.Email)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || usedAt.Valid || time.Now().After(expiresAt) {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	if err := validatePassword(req.Password, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = tx.Exec("UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		"UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		hashedPassword, user.ID,
+	)
+	if err != nil {
+		http.Error(w, "Error updating password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Sign out every device, since the old password may have been compromised
+	_, err = tx.Exec(
+		"UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = 'password_reset' WHERE user_id = $1 AND revoked_at IS NULL",
+		user.ID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
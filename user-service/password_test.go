@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidatePassword(t *testing.T) {
+	user := User{Username: "alice", Email: "alice.smith@example.com"}
+
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"correct-horse", true},
+		{"s3cure passphrase", true},
+		{"short1", false},
+		{"onlyletters", false},
+		{"1234567890", false},
+		{"my-alice-password", false},
+		{"alice.smith-2024", false},
+		{strings.Repeat("a1", 40), false},
+	}
+
+	for _, tt := range tests {
+		err := validatePassword(tt.password, user)
+		if (err == nil) != tt.valid {
+			t.Errorf("validatePassword(%q) = %v, want valid=%v", tt.password, err, tt.valid)
+		}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	tokens = testTokenConfig()
+	currentHash, err := bcrypt.GenerateFromPassword([]byte("old-password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		userID     string
+		body       string
+		wantStatus int
+	}{
+		{"success", "1", `{"current_password":"old-password1","new_password":"new-password2"}`, http.StatusNoContent},
+		{"wrong current password", "1", `{"current_password":"guess-1234","new_password":"new-password2"}`, http.StatusForbidden},
+		{"same password", "1", `{"current_password":"old-password1","new_password":"old-password1"}`, http.StatusBadRequest},
+		{"weak new password", "1", `{"current_password":"old-password1","new_password":"abc"}`, http.StatusBadRequest},
+		{"someone else's account", "2", `{"current_password":"old-password1","new_password":"new-password2"}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT id, username, email, password_hash", []string{"id", "username", "email", "password_hash"},
+				[]driver.Value{int64(1), "alice", "alice@example.com", string(currentHash)})
+			fake.OnExec("UPDATE users", 1)
+			fake.OnExec("UPDATE sessions", 1)
+			fake.OnExec("DELETE FROM password_reset_tokens", 0)
+
+			req := httptest.NewRequest("PUT", "/users/"+tt.userID+"/password", strings.NewReader(tt.body))
+			req = mux.SetURLVars(req, map[string]string{"id": tt.userID})
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(changePassword)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			success := tt.wantStatus == http.StatusNoContent
+			if fake.Ran("UPDATE sessions") != success {
+				t.Errorf("revoked other sessions = %v, want %v", fake.Ran("UPDATE sessions"), success)
+			}
+		})
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnQuery("SELECT id FROM users WHERE email", []string{"id"})
+
+	req := httptest.NewRequest("POST", "/users/password/forgot", strings.NewReader(`{"email":"nobody@example.com"}`))
+	rec := httptest.NewRecorder()
+	forgotPassword(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if fake.Ran("password_reset_tokens") {
+		t.Error("reset token created for unknown email")
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	resetColumns := []string{"id", "expires_at", "used_at", "user_id", "username", "email"}
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name       string
+		body       string
+		row        []driver.Value
+		wantStatus int
+	}{
+		{"valid token", `{"token":"abc","password":"new-password"}`, []driver.Value{int64(1), future, nil, int64(7), "alice", "alice@example.com"}, http.StatusNoContent},
+		{"unknown token", `{"token":"abc","password":"new-password"}`, nil, http.StatusBadRequest},
+		{"expired token", `{"token":"abc","password":"new-password"}`, []driver.Value{int64(1), past, nil, int64(7), "alice", "alice@example.com"}, http.StatusBadRequest},
+		{"used token", `{"token":"abc","password":"new-password"}`, []driver.Value{int64(1), future, past, int64(7), "alice", "alice@example.com"}, http.StatusBadRequest},
+		{"weak password", `{"token":"abc","password":"short"}`, []driver.Value{int64(1), future, nil, int64(7), "alice", "alice@example.com"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			if tt.row != nil {
+				fake.OnQuery("FROM password_reset_tokens", resetColumns, tt.row)
+			} else {
+				fake.OnQuery("FROM password_reset_tokens", resetColumns)
+			}
+			fake.OnExec("UPDATE password_reset_tokens", 1)
+			fake.OnExec("UPDATE users", 1)
+			fake.OnExec("UPDATE sessions", 2)
+
+			rec := httptest.NewRecorder()
+			resetPassword(rec, httptest.NewRequest("POST", "/users/password/reset", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			success := tt.wantStatus == http.StatusNoContent
+			if fake.Ran("UPDATE users") != success || fake.Ran("UPDATE sessions") != success {
+				t.Errorf("password update/session revocation ran = %v/%v, want %v", fake.Ran("UPDATE users"), fake.Ran("UPDATE sessions"), success)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Personal access tokens for scripts and CI (personal_token.go)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultPersonalTokenDays = 90
+	maxPersonalTokenDays     = 365
+)
+
+// personalTokenScopes are the permissions a personal access token may carry.
+// Account management is deliberately left out.
+var personalTokenScopes = []string{
+	"posts:write",
+	"posts:edit_any",
+	"posts:delete_any",
+	"comments:write",
+	"comments:moderate",
+	"taxonomy:manage",
+}
+
+// PersonalToken describes a personal access token; the secret itself is
+// only returned when the token is created
+type PersonalToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	Prefix     string     `json:"token_prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreatePersonalTokenRequest names a new token and picks its scopes
+type CreatePersonalTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// createPersonalToken issues a new personal access token for the caller.
+// A token can only carry scopes the caller currently holds.
+func createPersonalToken(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != mux.Vars(r)["id"] {
+		http.Error(w, "You can only create tokens for yourself", http.StatusForbidden)
+		return
+	}
+
+	var req CreatePersonalTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name is required and must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !contains(personalTokenScopes, scope) {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultPersonalTokenDays
+	}
+	if req.ExpiresInDays < 1 || req.ExpiresInDays > maxPersonalTokenDays {
+		http.Error(w, "expires_in_days must be between 1 and "+strconv.Itoa(maxPersonalTokenDays), http.StatusBadRequest)
+		return
+	}
+
+	// Check the scopes against the caller's current grants, not the token's
+	_, permissions, err := loadGrants(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error loading roles: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !contains(permissions, scope) {
+			http.Error(w, "You do not hold the permission "+scope, http.StatusForbidden)
+			return
+		}
+	}
+
+	secret, _, err := newSecretToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := PersonalToken{
+		Name:   req.Name,
+		Token:  auth.PersonalTokenPrefix + secret,
+		Scopes: req.Scopes,
+	}
+	token.Prefix = token.Token[:len(auth.PersonalTokenPrefix)+4]
+
+	err = db.QueryRow(
+		`INSERT INTO personal_access_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, expires_at`,
+		claims.UserID, token.Name, hashToken(token.Token), token.Prefix, pq.Array(token.Scopes),
+		time.Now().AddDate(0, 0, req.ExpiresInDays),
+	).Scan(&token.ID, &token.CreatedAt, &token.ExpiresAt)
+	if err != nil {
+		http.Error(w, "Error creating token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// getPersonalTokens lists a user's active personal access tokens
+func getPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !authorizeSelf(w, r, id) {
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT id, name, token_prefix, scopes, created_at, expires_at, last_used_at
+		FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY created_at DESC`,
+		id,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	personalTokens := []PersonalToken{}
+	for rows.Next() {
+		var t PersonalToken
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.CreatedAt, &t.ExpiresAt, &lastUsedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		personalTokens = append(personalTokens, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(personalTokens)
+}
+
+// revokePersonalToken revokes one of a user's personal access tokens
+func revokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorizeSelf(w, r, vars["id"]) {
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE personal_access_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		vars["tokenID"], vars["id"],
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCreatePersonalToken(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name       string
+		userID     string
+		body       string
+		wantStatus int
+	}{
+		{"success", "1", `{"name":"ci","scopes":["posts:write"]}`, http.StatusCreated},
+		{"scope not held", "1", `{"name":"ci","scopes":["comments:moderate"]}`, http.StatusForbidden},
+		{"unknown scope", "1", `{"name":"ci","scopes":["users:manage"]}`, http.StatusBadRequest},
+		{"no scopes", "1", `{"name":"ci","scopes":[]}`, http.StatusBadRequest},
+		{"expiry too long", "1", `{"name":"ci","scopes":["posts:write"],"expires_in_days":1000}`, http.StatusBadRequest},
+		{"someone else's account", "2", `{"name":"ci","scopes":["posts:write"]}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("array_agg", []string{"roles", "perms"}, []driver.Value{"{author}", "{posts:write,comments:write}"})
+			fake.OnQuery("INSERT INTO personal_access_tokens", []string{"id", "created_at", "expires_at"},
+				[]driver.Value{int64(5), time.Now(), time.Now().AddDate(0, 0, 90)})
+
+			req := httptest.NewRequest("POST", "/users/"+tt.userID+"/tokens", strings.NewReader(tt.body))
+			req = mux.SetURLVars(req, map[string]string{"id": tt.userID})
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(createPersonalToken)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusCreated {
+				if fake.Ran("INSERT INTO personal_access_tokens") {
+					t.Error("token stored for a rejected request")
+				}
+				return
+			}
+
+			var token PersonalToken
+			if err := json.NewDecoder(rec.Body).Decode(&token); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(token.Token, auth.PersonalTokenPrefix) || !strings.HasPrefix(token.Token, token.Prefix) {
+				t.Errorf("token = %q, prefix = %q", token.Token, token.Prefix)
+			}
+		})
+	}
+}
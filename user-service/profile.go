@@ -0,0 +1,153 @@
+// Public and private user profiles (profile.go)
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxDisplayNameLength = 100
+	maxBioLength         = 500
+	maxProfileLinks      = 5
+	maxURLLength         = 500
+)
+
+// userProfileColumns selects everything scanUserProfile reads
+const userProfileColumns = `id, username, email, email_verified_at IS NOT NULL,
+	display_name, bio, links, avatar_url, show_email, created_at, updated_at`
+
+// PublicUserResponse is a profile as anyone may see it. The email address
+// is only included when the user has chosen to show it.
+type PublicUserResponse struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	Links       []string  `json:"links"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// UpdateUserRequest changes a profile. Omitted fields keep their value.
+type UpdateUserRequest struct {
+	Username    *string   `json:"username"`
+	Email       *string   `json:"email"`
+	DisplayName *string   `json:"display_name"`
+	Bio         *string   `json:"bio"`
+	Links       *[]string `json:"links"`
+	AvatarURL   *string   `json:"avatar_url"`
+	ShowEmail   *bool     `json:"show_email"`
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUserProfile reads a row selected with userProfileColumns
+func scanUserProfile(row rowScanner) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.EmailVerified,
+		&u.DisplayName, &u.Bio, pq.Array(&u.Links), &u.AvatarURL, &u.ShowEmail, &u.CreatedAt, &u.UpdatedAt)
+	return u, err
+}
+
+// newUserResponse builds the owner's view of a profile
+func newUserResponse(u User) UserResponse {
+	links := u.Links
+	if links == nil {
+		links = []string{}
+	}
+	return UserResponse{
+		ID:            u.ID,
+		Username:      u.Username,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		DisplayName:   u.DisplayName,
+		Bio:           u.Bio,
+		Links:         links,
+		AvatarURL:     u.AvatarURL,
+		ShowEmail:     u.ShowEmail,
+		CreatedAt:     u.CreatedAt,
+	}
+}
+
+// newPublicUserResponse builds the view of a profile shown to everyone else
+func newPublicUserResponse(u User) PublicUserResponse {
+	private := newUserResponse(u)
+	public := PublicUserResponse{
+		ID:          private.ID,
+		Username:    private.Username,
+		DisplayName: private.DisplayName,
+		Bio:         private.Bio,
+		Links:       private.Links,
+		AvatarURL:   private.AvatarURL,
+		CreatedAt:   private.CreatedAt,
+	}
+	if u.ShowEmail {
+		public.Email = u.Email
+	}
+	return public
+}
+
+// validateProfile checks the fields of a profile update
+func validateProfile(req *UpdateUserRequest) error {
+	if req.Username != nil {
+		*req.Username = strings.TrimSpace(*req.Username)
+		if *req.Username == "" {
+			return errors.New("Username cannot be empty")
+		}
+	}
+	if req.Email != nil {
+		*req.Email = strings.TrimSpace(*req.Email)
+		if !strings.Contains(*req.Email, "@") {
+			return errors.New("Email address is invalid")
+		}
+	}
+	if req.DisplayName != nil {
+		*req.DisplayName = strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(*req.DisplayName) > maxDisplayNameLength {
+			return fmt.Errorf("Display name must be at most %d characters", maxDisplayNameLength)
+		}
+	}
+	if req.Bio != nil && utf8.RuneCountInString(*req.Bio) > maxBioLength {
+		return fmt.Errorf("Bio must be at most %d characters", maxBioLength)
+	}
+	if req.Links != nil {
+		if len(*req.Links) > maxProfileLinks {
+			return fmt.Errorf("At most %d links are allowed", maxProfileLinks)
+		}
+		for _, link := range *req.Links {
+			if err := validateProfileURL(link); err != nil {
+				return err
+			}
+		}
+	}
+	if req.AvatarURL != nil && *req.AvatarURL != "" {
+		if err := validateProfileURL(*req.AvatarURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateProfileURL accepts absolute http and https URLs only, so that
+// links cannot carry javascript: or data: payloads
+func validateProfileURL(raw string) error {
+	if len(raw) > maxURLLength {
+		return fmt.Errorf("URLs must be at most %d characters", maxURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not a valid http or https URL", raw)
+	}
+	return nil
+}
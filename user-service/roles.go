@@ -0,0 +1,193 @@
+// Roles and permissions (roles.go)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Role is a named set of permissions that can be granted to users
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserRolesResponse lists the roles held by a user
+type UserRolesResponse struct {
+	UserID      int      `json:"user_id"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// loadGrants returns the role and permission names held by a user
+func loadGrants(userID int) ([]string, []string, error) {
+	var roles, permissions []string
+	err := db.QueryRow(
+		`SELECT
+			COALESCE(array_agg(DISTINCT r.name) FILTER (WHERE r.name IS NOT NULL), '{}'),
+			COALESCE(array_agg(DISTINCT p.name) FILTER (WHERE p.name IS NOT NULL), '{}')
+		FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		WHERE ur.user_id = $1`,
+		userID,
+	).Scan(pq.Array(&roles), pq.Array(&permissions))
+	return roles, permissions, err
+}
+
+// getRoles lists every role and its permissions
+func getRoles(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(
+		`SELECT r.name, r.description, COALESCE(array_agg(p.name ORDER BY p.name) FILTER (WHERE p.name IS NOT NULL), '{}')
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		GROUP BY r.id
+		ORDER BY r.id`,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, &role.Description, pq.Array(&role.Permissions)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		roles = append(roles, role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+// getUserRoles returns the roles held by a user
+func getUserRoles(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	// Users may see their own roles; admins may see anyone's
+	if !authorizeSelf(w, r, id) {
+		return
+	}
+
+	var response UserRolesResponse
+	err := db.QueryRow("SELECT id FROM users WHERE id = $1", id).Scan(&response.UserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Roles, response.Permissions, err = loadGrants(response.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// assignRole grants a role to a user
+func assignRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	claims, _ := auth.FromContext(r.Context())
+
+	result, err := db.Exec(
+		`INSERT INTO user_roles (user_id, role_id, granted_by)
+		SELECT u.id, r.id, $3 FROM users u, roles r WHERE u.id = $1 AND r.name = $2
+		ON CONFLICT (user_id, role_id) DO NOTHING`,
+		vars["id"], vars["role"], claims.UserID,
+	)
+	if err != nil {
+		http.Error(w, "Error assigning role: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Nothing inserted means either the user or role is unknown, or the
+	// grant already exists
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		var exists bool
+		err = db.QueryRow(
+			`SELECT EXISTS(SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = $1 AND r.name = $2)`,
+			vars["id"], vars["role"],
+		).Scan(&exists)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "User or role not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeRole removes a role from a user and ends their sessions, so access
+// tokens still carrying the role stop working at once
+func revokeRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error revoking role: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"DELETE FROM user_roles WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)",
+		vars["id"], vars["role"],
+	)
+	if err != nil {
+		http.Error(w, "Error revoking role: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "User does not have this role", http.StatusNotFound)
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = 'role_revoked' WHERE user_id = $1 AND revoked_at IS NULL",
+		vars["id"],
+	)
+	if err != nil {
+		http.Error(w, "Error revoking role: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error revoking role: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAssignRole(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name        string
+		role        string
+		permissions []string
+		inserted    int64
+		exists      bool
+		wantStatus  int
+	}{
+		{"grant", "editor", []string{"users:manage"}, 1, true, http.StatusNoContent},
+		{"grant again", "editor", []string{"users:manage"}, 0, true, http.StatusNoContent},
+		{"unknown role", "overlord", []string{"users:manage"}, 0, false, http.StatusNotFound},
+		{"without users:manage", "editor", []string{"posts:edit_any"}, 1, true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("INSERT INTO user_roles", tt.inserted)
+			fake.OnQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{tt.exists})
+
+			req := httptest.NewRequest("PUT", "/users/2/roles/"+tt.role, nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "2", "role": tt.role})
+			req.Header.Set("Authorization", bearer(t, 1, tt.permissions...))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(auth.RequirePermission("users:manage", assignRole))(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusForbidden && fake.Ran("INSERT INTO user_roles") {
+				t.Error("role granted without users:manage")
+			}
+		})
+	}
+}
+
+func TestRevokeRole(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name        string
+		permissions []string
+		deleted     int64
+		wantStatus  int
+	}{
+		{"revoke", []string{"users:manage"}, 1, http.StatusNoContent},
+		{"role not held", []string{"users:manage"}, 0, http.StatusNotFound},
+		{"without users:manage", []string{"comments:moderate"}, 1, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("DELETE FROM user_roles", tt.deleted)
+			fake.OnExec("role_revoked", 3)
+
+			req := httptest.NewRequest("DELETE", "/users/2/roles/editor", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "2", "role": "editor"})
+			req.Header.Set("Authorization", bearer(t, 1, tt.permissions...))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(auth.RequirePermission("users:manage", revokeRole))(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			// Access tokens carrying the role must not outlive it
+			revoked := tt.wantStatus == http.StatusNoContent
+			if fake.Ran("role_revoked") != revoked {
+				t.Errorf("sessions ended = %v, want %v", fake.Ran("role_revoked"), revoked)
+			}
+		})
+	}
+}
+
+func TestGetUserRoles(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name        string
+		callerID    int
+		permissions []string
+		found       bool
+		wantStatus  int
+	}{
+		{"own roles", 2, nil, true, http.StatusOK},
+		{"another user's roles", 3, nil, true, http.StatusForbidden},
+		{"by user manager", 1, []string{"users:manage"}, true, http.StatusOK},
+		{"unknown user", 1, []string{"users:manage"}, false, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			if tt.found {
+				fake.OnQuery("SELECT id FROM users", []string{"id"}, []driver.Value{int64(2)})
+			} else {
+				fake.OnQuery("SELECT id FROM users", []string{"id"})
+			}
+			fake.OnQuery("array_agg", []string{"roles", "perms"}, []driver.Value{"{editor}", "{posts:edit_any,posts:write}"})
+
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/users/2/roles", nil), map[string]string{"id": "2"})
+			req.Header.Set("Authorization", bearer(t, tt.callerID, tt.permissions...))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(getUserRoles)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response UserRolesResponse
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.UserID != 2 || len(response.Roles) != 1 || len(response.Permissions) != 2 {
+				t.Errorf("unexpected response %+v", response)
+			}
+		})
+	}
+}
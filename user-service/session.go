@@ -0,0 +1,297 @@
+// Refresh tokens and login sessions (session.go)
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+// Session is a login on one device, spanning a family of rotated refresh tokens
+type Session struct {
+	ID         int       `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// RefreshRequest is used to exchange a refresh token for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenResponse is returned whenever new tokens are issued
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// newSecretToken returns a random opaque token and the hash stored for it
+func newSecretToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken hashes a high-entropy token for storage and lookup
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP returns the address of the client that sent the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// createSession starts a new session family and returns its first refresh token
+func createSession(userID int, r *http.Request) (int, string, error) {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return 0, "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var sessionID int
+	err = tx.QueryRow(
+		"INSERT INTO sessions (user_id, user_agent, ip_address, expires_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		userID, r.UserAgent(), clientIP(r), time.Now().Add(tokens.refreshTTL),
+	).Scan(&sessionID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = tx.Exec("INSERT INTO refresh_tokens (session_id, token_hash) VALUES ($1, $2)", sessionID, hash)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return sessionID, token, tx.Commit()
+}
+
+// rotateRefreshToken exchanges a refresh token for a new one in the same
+// session. Presenting a token that was already rotated revokes the session.
+func rotateRefreshToken(token string) (User, int, string, error) {
+	var user User
+	var tokenID, sessionID int
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+
+	tx, err := db.Begin()
+	if err != nil {
+		return user, 0, "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`SELECT rt.id, rt.used_at, s.id, s.revoked_at, s.expires_at, u.id, u.username, u.email_verified_at IS NOT NULL
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s`,
+		hashToken(token),
+	).Scan(&tokenID, &usedAt, &sessionID, &revokedAt, &expiresAt, &user.ID, &user.Username, &user.EmailVerified)
+	if err == sql.ErrNoRows {
+		return user, 0, "", errInvalidRefreshToken
+	}
+	if err != nil {
+		return user, 0, "", err
+	}
+
+	// A replayed token means it leaked: kill the whole family
+	if usedAt.Valid {
+		if !revokedAt.Valid {
+			_, err = tx.Exec(
+				"UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = 'refresh_token_reuse' WHERE id = $1",
+				sessionID,
+			)
+			if err != nil {
+				return user, 0, "", err
+			}
+			if err := tx.Commit(); err != nil {
+				return user, 0, "", err
+			}
+			log.Printf("Refresh token reuse detected for user %d, session %d revoked", user.ID, sessionID)
+		}
+		return user, 0, "", errRefreshTokenReused
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return user, 0, "", errInvalidRefreshToken
+	}
+
+	newToken, newHash, err := newSecretToken()
+	if err != nil {
+		return user, 0, "", err
+	}
+
+	if _, err = tx.Exec("UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID); err != nil {
+		return user, 0, "", err
+	}
+	if _, err = tx.Exec("INSERT INTO refresh_tokens (session_id, token_hash) VALUES ($1, $2)", sessionID, newHash); err != nil {
+		return user, 0, "", err
+	}
+	_, err = tx.Exec(
+		"UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, expires_at = $1 WHERE id = $2",
+		time.Now().Add(tokens.refreshTTL), sessionID,
+	)
+	if err != nil {
+		return user, 0, "", err
+	}
+
+	return user, sessionID, newToken, tx.Commit()
+}
+
+// refreshToken handles refresh token rotation
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	user, sessionID, newRefresh, err := rotateRefreshToken(req.RefreshToken)
+	if err == errInvalidRefreshToken || err == errRefreshTokenReused {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error refreshing token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Pick up any role changes made since the last token was issued
+	user.Roles, user.Permissions, err = loadGrants(user.ID)
+	if err != nil {
+		http.Error(w, "Error loading roles: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, err := tokens.issueAccessToken(user, sessionID)
+	if err != nil {
+		http.Error(w, "Error issuing token", http.StatusInternalServerError)
+		return
+	}
+
+	response := TokenResponse{
+		AccessToken:      accessToken,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(tokens.accessTTL.Seconds()),
+		RefreshToken:     newRefresh,
+		RefreshExpiresIn: int(tokens.refreshTTL.Seconds()),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getSessions lists the caller's active sessions
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	claims, _ := auth.FromContext(r.Context())
+	if claims.UserID != userID {
+		http.Error(w, "You can only view your own sessions", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT id, user_agent, ip_address, created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_used_at DESC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.Current = s.ID == claims.SessionID
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// deleteSession revokes one of the caller's sessions
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, _ := strconv.Atoi(vars["id"])
+
+	// Admins may revoke sessions on behalf of a user
+	if !authorizeSelf(w, r, vars["id"]) {
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = 'user_revoked' WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		vars["sid"], userID,
+	)
+	if err != nil {
+		http.Error(w, "Error revoking session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+var refreshColumns = []string{"id", "used_at", "session_id", "revoked_at", "expires_at", "user_id", "username", "email_verified"}
+
+func TestRefreshToken(t *testing.T) {
+	tokens = testTokenConfig()
+	tokens.refreshTTL = time.Hour
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		body       string
+		row        []driver.Value // nil when the token is unknown
+		wantStatus int
+		wantRevoke bool
+	}{
+		{"rotation", `{"refresh_token":"old"}`,
+			[]driver.Value{int64(1), nil, int64(7), nil, now.Add(time.Hour), int64(2), "alice", true}, http.StatusOK, false},
+		{"reused token", `{"refresh_token":"old"}`,
+			[]driver.Value{int64(1), now.Add(-time.Minute), int64(7), nil, now.Add(time.Hour), int64(2), "alice", true}, http.StatusUnauthorized, true},
+		{"reused token of a revoked session", `{"refresh_token":"old"}`,
+			[]driver.Value{int64(1), now.Add(-time.Minute), int64(7), now.Add(-time.Minute), now.Add(time.Hour), int64(2), "alice", true}, http.StatusUnauthorized, false},
+		{"expired session", `{"refresh_token":"old"}`,
+			[]driver.Value{int64(1), nil, int64(7), nil, now.Add(-time.Minute), int64(2), "alice", true}, http.StatusUnauthorized, false},
+		{"revoked session", `{"refresh_token":"old"}`,
+			[]driver.Value{int64(1), nil, int64(7), now.Add(-time.Minute), now.Add(time.Hour), int64(2), "alice", true}, http.StatusUnauthorized, false},
+		{"unknown token", `{"refresh_token":"old"}`, nil, http.StatusUnauthorized, false},
+		{"missing token", `{}`, nil, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			if tt.row != nil {
+				fake.OnQuery("FROM refresh_tokens rt", refreshColumns, tt.row)
+			} else {
+				fake.OnQuery("FROM refresh_tokens rt", refreshColumns)
+			}
+			fake.OnExec("refresh_token_reuse", 1)
+			fake.OnExec("UPDATE refresh_tokens SET used_at", 1)
+			fake.OnExec("INSERT INTO refresh_tokens", 1)
+			fake.OnExec("UPDATE sessions SET last_used_at", 1)
+			fake.OnQuery("array_agg", []string{"roles", "perms"}, []driver.Value{"{author}", "{posts:write}"})
+
+			rec := httptest.NewRecorder()
+			refreshToken(rec, httptest.NewRequest("POST", "/users/token/refresh", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if fake.Ran("refresh_token_reuse") != tt.wantRevoke {
+				t.Errorf("session revoked = %v, want %v", fake.Ran("refresh_token_reuse"), tt.wantRevoke)
+			}
+			rotated := tt.wantStatus == http.StatusOK
+			if fake.Ran("SET used_at") != rotated || fake.Ran("INSERT INTO refresh_tokens") != rotated {
+				t.Errorf("old token used = %v, new token stored = %v, want %v",
+					fake.Ran("SET used_at"), fake.Ran("INSERT INTO refresh_tokens"), rotated)
+			}
+			if !rotated {
+				return
+			}
+
+			var response TokenResponse
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.RefreshToken == "" || response.RefreshToken == "old" {
+				t.Errorf("refresh token was not rotated: %q", response.RefreshToken)
+			}
+			claims, err := tokens.parse(response.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.UserID != 2 || claims.SessionID != 7 || !claims.Can("posts:write") {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+var sessionColumns = []string{"id", "user_agent", "ip_address", "created_at", "last_used_at", "expires_at"}
+
+func TestGetSessions(t *testing.T) {
+	tokens = testTokenConfig()
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		userID     string
+		wantStatus int
+	}{
+		{"own sessions", "2", http.StatusOK},
+		{"another user's sessions", "3", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("FROM sessions", sessionColumns,
+				[]driver.Value{int64(7), "curl", "10.0.0.1", now, now, now.Add(time.Hour)},
+				[]driver.Value{int64(8), "firefox", "10.0.0.2", now, now, now.Add(time.Hour)})
+
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/users/"+tt.userID+"/sessions", nil), map[string]string{"id": tt.userID})
+			req = req.WithContext(auth.NewContext(req.Context(), &auth.Claims{UserID: 2, SessionID: 8}))
+			rec := httptest.NewRecorder()
+			getSessions(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				if fake.Ran("FROM sessions") {
+					t.Error("sessions listed for another user")
+				}
+				return
+			}
+			var sessions []Session
+			if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 2 || sessions[0].Current || !sessions[1].Current {
+				t.Errorf("unexpected sessions %+v", sessions)
+			}
+		})
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	tokens = testTokenConfig()
+
+	tests := []struct {
+		name        string
+		userID      string
+		callerID    int
+		permissions []string
+		revoked     int64
+		wantStatus  int
+	}{
+		{"own session", "2", 2, nil, 1, http.StatusNoContent},
+		// The session belongs to someone else, so no row of user 2 matches
+		{"another user's session id", "2", 2, nil, 0, http.StatusNotFound},
+		{"another user's session path", "3", 2, nil, 1, http.StatusForbidden},
+		{"by user manager", "3", 2, []string{"users:manage"}, 1, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnExec("UPDATE sessions", tt.revoked)
+
+			req := httptest.NewRequest("DELETE", "/users/"+tt.userID+"/sessions/7", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tt.userID, "sid": "7"})
+			req.Header.Set("Authorization", bearer(t, tt.callerID, tt.permissions...))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(deleteSession)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusForbidden && fake.Ran("UPDATE sessions") {
+				t.Error("session revoked without permission")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Access token signing and verification (token.go)
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"blog-shared/auth"
+)
+
+// tokenConfig holds the keys and settings used to sign and verify tokens
+type tokenConfig struct {
+	algorithm  string
+	hmacKey    []byte
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+	issuer     string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+var tokens *tokenConfig
+
+// loadTokenConfig reads the token settings from the environment.
+// HS256 needs JWT_SECRET; RS256 needs JWT_PRIVATE_KEY_FILE and optionally
+// JWT_PUBLIC_KEY_FILE (derived from the private key when unset).
+func loadTokenConfig() (*tokenConfig, error) {
+	ttl, err := time.ParseDuration(getEnv("ACCESS_TOKEN_TTL", "15m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_TOKEN_TTL: %w", err)
+	}
+	refreshTTL, err := time.ParseDuration(getEnv("REFRESH_TOKEN_TTL", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REFRESH_TOKEN_TTL: %w", err)
+	}
+
+	cfg := &tokenConfig{
+		algorithm:  getEnv("JWT_ALGORITHM", "HS256"),
+		issuer:     getEnv("JWT_ISSUER", "blog-user-service"),
+		accessTTL:  ttl,
+		refreshTTL: refreshTTL,
+	}
+
+	switch cfg.algorithm {
+	case "HS256":
+		secret := os.Getenv("JWT_SECRET")
+		if len(secret) < 32 {
+			return nil, errors.New("JWT_SECRET must be set to at least 32 characters")
+		}
+		cfg.hmacKey = []byte(secret)
+	case "RS256":
+		keyPEM, err := os.ReadFile(os.Getenv("JWT_PRIVATE_KEY_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT_PRIVATE_KEY_FILE: %w", err)
+		}
+		cfg.privateKey, err = parseRSAPrivateKey(keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		cfg.publicKey = &cfg.privateKey.PublicKey
+		if path := os.Getenv("JWT_PUBLIC_KEY_FILE"); path != "" {
+			pubPEM, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading JWT_PUBLIC_KEY_FILE: %w", err)
+			}
+			cfg.publicKey, err = auth.ParseRSAPublicKey(pubPEM)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %q", cfg.algorithm)
+	}
+
+	return cfg, nil
+}
+
+// parseRSAPrivateKey decodes a PKCS#1 or PKCS#8 PEM encoded RSA private key
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// issueAccessToken mints a signed access token for the given user and session
+func (c *tokenConfig) issueAccessToken(user User, sessionID int) (string, error) {
+	now := time.Now()
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	return c.sign(auth.Claims{
+		Subject:       strconv.Itoa(user.ID),
+		Issuer:        c.issuer,
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     now.Add(c.accessTTL).Unix(),
+		ID:            hex.EncodeToString(jti),
+		UserID:        user.ID,
+		Username:      user.Username,
+		SessionID:     sessionID,
+		EmailVerified: user.EmailVerified,
+		Roles:         user.Roles,
+		Permissions:   user.Permissions,
+	})
+}
+
+// sign encodes and signs the claims as a compact JWT
+func (c *tokenConfig) sign(claims auth.Claims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": c.algorithm, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch c.algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, c.hmacKey)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, c.privateKey, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", c.algorithm)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parse verifies a compact JWT and returns its claims
+func (c *tokenConfig) parse(token string) (*auth.Claims, error) {
+	v := auth.Verifier{Algorithm: c.algorithm, HMACKey: c.hmacKey, PublicKey: c.publicKey, Issuer: c.issuer}
+	return v.Parse(token)
+}
+
+// authn checks bearer tokens against tokens and the sessions in db. Personal
+// access tokens are not accepted here, so they cannot manage accounts. See
+// blog-shared/auth.
+var authn = &auth.Authenticator{
+	Parse: func(token string) (*auth.Claims, error) { return tokens.parse(token) },
+	DB:    func() *sql.DB { return db },
+}
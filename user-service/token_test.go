@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"blog-shared/auth"
+)
+
+func testTokenConfig() *tokenConfig {
+	return &tokenConfig{
+		algorithm: "HS256",
+		hmacKey:   []byte("0123456789abcdef0123456789abcdef"),
+		issuer:    "blog-user-service",
+		accessTTL: time.Minute,
+	}
+}
+
+func TestIssueAndParseAccessToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := map[string]*tokenConfig{
+		"HS256": testTokenConfig(),
+		"RS256": {
+			algorithm:  "RS256",
+			privateKey: rsaKey,
+			publicKey:  &rsaKey.PublicKey,
+			issuer:     "blog-user-service",
+			accessTTL:  time.Minute,
+		},
+	}
+
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			token, err := cfg.issueAccessToken(User{ID: 42, Username: "alice"}, 3)
+			if err != nil {
+				t.Fatalf("issueAccessToken: %v", err)
+			}
+			claims, err := cfg.parse(token)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if claims.UserID != 42 || claims.Subject != "42" || claims.Username != "alice" || claims.SessionID != 3 {
+				t.Errorf("unexpected claims: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestParseRejectsBadTokens(t *testing.T) {
+	cfg := testTokenConfig()
+	valid, err := cfg.issueAccessToken(User{ID: 1, Username: "bob"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+
+	other := testTokenConfig()
+	other.hmacKey = []byte("ffffffffffffffffffffffffffffffff")
+	forged, _ := other.issueAccessToken(User{ID: 1, Username: "bob"}, 0)
+
+	expired, _ := cfg.sign(auth.Claims{Subject: "1", UserID: 1, Issuer: cfg.issuer, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+
+	wrongIssuer, _ := cfg.sign(auth.Claims{Subject: "1", UserID: 1, Issuer: "someone-else", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+
+	// {"alg":"none","typ":"JWT"}
+	unsigned := "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0." + parts[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"malformed", "not-a-token"},
+		{"tampered payload", parts[0] + "." + parts[1] + "x." + parts[2]},
+		{"wrong key", forged},
+		{"expired", expired},
+		{"wrong issuer", wrongIssuer},
+		{"alg none", unsigned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := cfg.parse(tt.token); err == nil {
+				t.Errorf("expected %q to be rejected", tt.name)
+			}
+		})
+	}
+}
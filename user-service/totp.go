@@ -0,0 +1,588 @@
+// TOTP two-factor authentication (totp.go)
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"blog-shared/auth"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1 // accept codes one step either side of now
+	recoveryCodeCount = 10
+	mfaChallengeTTL   = 5 * time.Minute
+	mfaMaxAttempts    = 5
+)
+
+// clock returns the current time; tests replace it with a fixed clock
+var clock = time.Now
+
+// totpKey encrypts TOTP secrets at rest and keys recovery code hashes
+var totpKey []byte
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is returned when a user starts enrolling an authenticator
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// TOTPCodeRequest carries a code from the user's authenticator app
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// DisableTOTPRequest turns two-factor authentication off
+type DisableTOTPRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// RecoveryCodesResponse lists one-time recovery codes; they are only shown once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFAChallengeResponse is returned by loginUser when a second factor is needed
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// MFALoginRequest completes a login with a TOTP or recovery code
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// loadTOTPKey reads the 32-byte TOTP_ENCRYPTION_KEY, base64 encoded. Without
+// it the service runs with two-factor authentication unavailable.
+func loadTOTPKey() ([]byte, error) {
+	encoded := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY must be set to 32 base64-encoded bytes")
+	}
+	return key, nil
+}
+
+// totpAvailable writes a 503 response when no TOTP_ENCRYPTION_KEY is set
+func totpAvailable(w http.ResponseWriter) bool {
+	if totpKey == nil {
+		http.Error(w, "Two-factor authentication is not configured", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// totpCode computes the RFC 6238 code for the given time
+func totpCode(secret []byte, t time.Time) string {
+	return hotpCode(secret, uint64(t.Unix()/totpPeriod))
+}
+
+// hotpCode computes the RFC 4226 code for a counter value
+func hotpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// verifyTOTP checks a code against the steps around t and returns the
+// matching step. Steps at or before lastStep are rejected so a code cannot
+// be replayed.
+func verifyTOTP(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotpCode(secret, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthURI builds the provisioning URI shown as a QR code by authenticator apps
+func otpauthURI(secret []byte, account string) string {
+	issuer := getEnv("TOTP_ISSUER", "Blog")
+	params := url.Values{}
+	params.Set("secret", base32NoPad.EncodeToString(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// encryptTOTPSecret seals a secret with AES-GCM, bound to the owning user
+func encryptTOTPSecret(secret []byte, userID int) (string, error) {
+	block, err := aes.NewCipher(totpKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, secret, []byte(strconv.Itoa(userID)))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptTOTPSecret reverses encryptTOTPSecret
+func decryptTOTPSecret(encoded string, userID int) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(totpKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("TOTP secret is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(userID)))
+}
+
+// hashRecoveryCode hashes a normalized recovery code with the TOTP key
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	mac := hmac.New(sha256.New, totpKey)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newRecoveryCodes generates a fresh set of recovery codes like "abcde-fghij"
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32NoPad.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// totpEnabled reports whether the user has confirmed a TOTP authenticator
+func totpEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)",
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// enrollTOTP generates a new, unconfirmed TOTP secret for the caller
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	if !totpAvailable(w) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != id {
+		http.Error(w, "You can only manage your own two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	enabled, err := totpEnabled(claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encrypted, err := encryptTOTPSecret(secret, claims.UserID)
+	if err != nil {
+		http.Error(w, "Error encrypting secret: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Starting over replaces any enrollment that was never confirmed
+	_, err = db.Exec(
+		`INSERT INTO user_totp (user_id, secret_encrypted) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret_encrypted = EXCLUDED.secret_encrypted, last_used_step = 0, created_at = CURRENT_TIMESTAMP
+		WHERE user_totp.confirmed_at IS NULL`,
+		claims.UserID, encrypted,
+	)
+	if err != nil {
+		http.Error(w, "Error saving secret: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := TOTPEnrollment{
+		Secret:     base32NoPad.EncodeToString(secret),
+		OTPAuthURI: otpauthURI(secret, claims.Username),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// confirmTOTP enables two-factor authentication once the user proves their
+// authenticator works, and returns their recovery codes
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	if !totpAvailable(w) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != id {
+		http.Error(w, "You can only manage your own two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var encrypted string
+	var confirmedAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT secret_encrypted, confirmed_at FROM user_totp WHERE user_id = $1 FOR UPDATE",
+		claims.UserID,
+	).Scan(&encrypted, &confirmedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Start enrollment first", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if confirmedAt.Valid {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := decryptTOTPSecret(encrypted, claims.UserID)
+	if err != nil {
+		http.Error(w, "Error decrypting secret", http.StatusInternalServerError)
+		return
+	}
+	step, ok := verifyTOTP(secret, req.Code, clock(), 0)
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE user_totp SET confirmed_at = CURRENT_TIMESTAMP, last_used_step = $1 WHERE user_id = $2",
+		step, claims.UserID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", claims.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, code := range codes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", claims.UserID, hashRecoveryCode(code))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// disableTOTP turns off two-factor authentication after re-checking the
+// password and a current code
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+	if !totpAvailable(w) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	claims, _ := auth.FromContext(r.Context())
+	if strconv.Itoa(claims.UserID) != id {
+		http.Error(w, "You can only manage your own two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	var req DisableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var hashedPassword, encrypted string
+	var lastStep int64
+	err := db.QueryRow(
+		`SELECT u.password_hash, t.secret_encrypted, t.last_used_step
+		FROM users u JOIN user_totp t ON t.user_id = u.id
+		WHERE u.id = $1 AND t.confirmed_at IS NOT NULL`,
+		claims.UserID,
+	).Scan(&hashedPassword, &encrypted, &lastStep)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if checkPassword(hashedPassword, req.Password) != nil {
+		http.Error(w, "Password is incorrect", http.StatusForbidden)
+		return
+	}
+	secret, err := decryptTOTPSecret(encrypted, claims.UserID)
+	if err != nil {
+		http.Error(w, "Error decrypting secret", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := verifyTOTP(secret, req.Code, clock(), lastStep); !ok {
+		http.Error(w, "Invalid code", http.StatusForbidden)
+		return
+	}
+
+	// Recovery codes are removed by the cascade from user_totp
+	if _, err := db.Exec("DELETE FROM user_totp WHERE user_id = $1", claims.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startMFAChallenge responds to a correct password with a short-lived
+// challenge token that must be completed with a second factor. Without
+// TOTP_ENCRYPTION_KEY no challenge could be completed, so the login of an
+// enrolled account fails closed with 503 instead of skipping the second
+// factor.
+func startMFAChallenge(w http.ResponseWriter, user User) {
+	if !totpAvailable(w) {
+		return
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO mfa_challenges (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		user.ID, hash, clock().Add(mfaChallengeTTL),
+	)
+	if err != nil {
+		http.Error(w, "Error creating challenge: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int(mfaChallengeTTL.Seconds()),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// loginMFA completes a login challenge with a TOTP or recovery code
+func loginMFA(w http.ResponseWriter, r *http.Request) {
+	if !totpAvailable(w) {
+		return
+	}
+
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "mfa_token and a code or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var challengeID, attempts int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	var user User
+	var encrypted string
+	var lastStep int64
+	err = tx.QueryRow(
+		`SELECT c.id, c.attempts, c.expires_at, c.used_at,
+			u.id, u.username, u.email, u.email_verified_at IS NOT NULL, u.created_at, u.updated_at,
+			t.secret_encrypted, t.last_used_step
+		FROM mfa_challenges c
+		JOIN users u ON u.id = c.user_id
+		JOIN user_totp t ON t.user_id = u.id AND t.confirmed_at IS NOT NULL
+		WHERE c.token_hash = $1
+		FOR UPDATE OF c, t`,
+		hashToken(req.MFAToken),
+	).Scan(&challengeID, &attempts, &expiresAt, &usedAt,
+		&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.CreatedAt, &user.UpdatedAt,
+		&encrypted, &lastStep)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || usedAt.Valid || clock().After(expiresAt) || attempts >= mfaMaxAttempts {
+		http.Error(w, "Invalid or expired challenge, please log in again", http.StatusUnauthorized)
+		return
+	}
+
+	verified := false
+	if req.Code != "" {
+		secret, err := decryptTOTPSecret(encrypted, user.ID)
+		if err != nil {
+			http.Error(w, "Error decrypting secret", http.StatusInternalServerError)
+			return
+		}
+		if step, ok := verifyTOTP(secret, req.Code, clock(), lastStep); ok {
+			if _, err := tx.Exec("UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2", step, user.ID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			verified = true
+		}
+	} else {
+		result, err := tx.Exec(
+			"UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+			user.ID, hashRecoveryCode(req.RecoveryCode),
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		verified = n == 1
+	}
+
+	if !verified {
+		// Count the failure outside the rolled-back transaction
+		tx.Rollback()
+		if _, err := db.Exec("UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = $1", challengeID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Wrong second factors count towards the account lockout too
+		if err := recordLoginFailure(user.Email, clientIP(r), user.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE mfa_challenges SET used_at = CURRENT_TIMESTAMP WHERE id = $1", challengeID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	completeLogin(w, r, user)
+}
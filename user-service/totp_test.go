@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// rfcSecret is the SHA1 key from the RFC 6238 test vectors
+var rfcSecret = []byte("12345678901234567890")
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// RFC 6238 lists 8-digit codes; the 6-digit code is their last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(rfcSecret, time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	previous := totpCode(rfcSecret, now.Add(-totpPeriod*time.Second))
+	tooOld := totpCode(rfcSecret, now.Add(-2*totpPeriod*time.Second))
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		valid    bool
+	}{
+		{"current step", "050471", 0, true},
+		{"spaces are ignored", "050 471", 0, true},
+		{"previous step within skew", previous, 0, true},
+		{"outside skew", tooOld, 0, false},
+		{"replayed step", "050471", step, false},
+		{"wrong code", "123456", 0, false},
+		{"wrong length", "50471", 0, false},
+	}
+
+	for _, tt := range tests {
+		if _, ok := verifyTOTP(rfcSecret, tt.code, now, tt.lastStep); ok != tt.valid {
+			t.Errorf("%s: verifyTOTP(%q) = %v, want %v", tt.name, tt.code, ok, tt.valid)
+		}
+	}
+}
+
+func TestTOTPSecretEncryption(t *testing.T) {
+	totpKey = []byte(strings.Repeat("k", 32))
+
+	encrypted, err := encryptTOTPSecret(rfcSecret, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, string(rfcSecret)) {
+		t.Fatal("secret stored in plain text")
+	}
+
+	secret, err := decryptTOTPSecret(encrypted, 7)
+	if err != nil || string(secret) != string(rfcSecret) {
+		t.Fatalf("decrypt = %q, %v", secret, err)
+	}
+	if _, err := decryptTOTPSecret(encrypted, 8); err == nil {
+		t.Error("secret decrypted for a different user")
+	}
+}
+
+func TestLoginMFA(t *testing.T) {
+	tokens = testTokenConfig()
+	totpKey = []byte(strings.Repeat("k", 32))
+	now := time.Unix(1111111111, 0)
+	clock = func() time.Time { return now }
+	defer func() { clock = time.Now }()
+
+	encrypted, err := encryptTOTPSecret(rfcSecret, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := []string{"id", "attempts", "expires_at", "used_at", "user_id", "username", "email", "email_verified",
+		"created_at", "updated_at", "secret_encrypted", "last_used_step"}
+	challenge := func(attempts int64, expiresAt time.Time) []driver.Value {
+		return []driver.Value{int64(3), attempts, expiresAt, nil, int64(7), "alice", "alice@example.com", true,
+			now, now, encrypted, int64(0)}
+	}
+
+	tests := []struct {
+		name         string
+		body         string
+		row          []driver.Value
+		recoveryUsed int64
+		wantStatus   int
+	}{
+		{"valid code", `{"mfa_token":"abc","code":"050471"}`, challenge(0, now.Add(time.Minute)), 0, http.StatusOK},
+		{"valid recovery code", `{"mfa_token":"abc","recovery_code":"abcde-fghij"}`, challenge(0, now.Add(time.Minute)), 1, http.StatusOK},
+		{"wrong code", `{"mfa_token":"abc","code":"123456"}`, challenge(0, now.Add(time.Minute)), 0, http.StatusUnauthorized},
+		{"used recovery code", `{"mfa_token":"abc","recovery_code":"abcde-fghij"}`, challenge(0, now.Add(time.Minute)), 0, http.StatusUnauthorized},
+		{"expired challenge", `{"mfa_token":"abc","code":"050471"}`, challenge(0, now.Add(-time.Second)), 0, http.StatusUnauthorized},
+		{"too many attempts", `{"mfa_token":"abc","code":"050471"}`, challenge(mfaMaxAttempts, now.Add(time.Minute)), 0, http.StatusUnauthorized},
+		{"unknown challenge", `{"mfa_token":"abc","code":"050471"}`, nil, 0, http.StatusUnauthorized},
+		{"missing code", `{"mfa_token":"abc"}`, nil, 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			if tt.row != nil {
+				fake.OnQuery("FROM mfa_challenges", columns, tt.row)
+			} else {
+				fake.OnQuery("FROM mfa_challenges", columns)
+			}
+			fake.OnExec("UPDATE user_totp", 1)
+			fake.OnExec("UPDATE recovery_codes", tt.recoveryUsed)
+			fake.OnExec("UPDATE mfa_challenges SET attempts", 1)
+			fake.OnExec("UPDATE mfa_challenges SET used_at", 1)
+			fake.OnQuery("INSERT INTO login_throttles", []string{"failures"}, []driver.Value{int64(1)})
+			fake.OnQuery("array_agg", []string{"roles", "perms"}, []driver.Value{"{author}", "{posts:write}"})
+			fake.OnExec("SET deletion_scheduled_for = NULL", 0)
+			fake.OnQuery("INSERT INTO sessions", []string{"id"}, []driver.Value{int64(11)})
+			fake.OnExec("INSERT INTO refresh_tokens", 1)
+
+			rec := httptest.NewRecorder()
+			loginMFA(rec, httptest.NewRequest("POST", "/users/login/2fa", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			success := tt.wantStatus == http.StatusOK
+			if fake.Ran("INSERT INTO sessions") != success {
+				t.Errorf("session created = %v, want %v", fake.Ran("INSERT INTO sessions"), success)
+			}
+			if tt.name == "wrong code" && !fake.Ran("SET attempts") {
+				t.Error("failed attempt was not counted")
+			}
+		})
+	}
+}
+
+func TestTOTPWithoutKey(t *testing.T) {
+	t.Setenv("TOTP_ENCRYPTION_KEY", "")
+	key, err := loadTOTPKey()
+	if key != nil || err != nil {
+		t.Fatalf("loadTOTPKey() = %v, %v; want no key and no error", key, err)
+	}
+	t.Setenv("TOTP_ENCRYPTION_KEY", "too-short")
+	if _, err := loadTOTPKey(); err == nil {
+		t.Error("malformed key accepted")
+	}
+
+	tokens = testTokenConfig()
+	previous := totpKey
+	totpKey = nil
+	defer func() { totpKey = previous }()
+
+	handlers := map[string]http.HandlerFunc{
+		"enroll":    authn.RequireAuth(enrollTOTP),
+		"verify":    authn.RequireAuth(confirmTOTP),
+		"disable":   authn.RequireAuth(disableTOTP),
+		"login/2fa": loginMFA,
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			req := httptest.NewRequest("POST", "/", strings.NewReader(`{"mfa_token":"t","code":"123456"}`))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, http.StatusServiceUnavailable, rec.Body.String())
+			}
+			if fake.Ran("") {
+				t.Error("database used without a TOTP key")
+			}
+		})
+	}
+
+	// Enrolled accounts cannot sign in until the key is back, everyone else can
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct-password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, enrolled := range []bool{true, false} {
+		t.Run("login enrolled="+strconv.FormatBool(enrolled), func(t *testing.T) {
+			fake := useFakeDB(t)
+			now := time.Now()
+			fake.OnQuery("MAX(locked_until)", []string{"locked_until"}, []driver.Value{nil})
+			fake.OnQuery("FROM users WHERE email", []string{"id", "username", "email", "email_verified", "password_hash", "created_at", "updated_at"},
+				[]driver.Value{int64(1), "alice", "alice@example.com", true, string(hash), now, now})
+			fake.OnExec("DELETE FROM login_throttles", 1)
+			fake.OnQuery("FROM user_totp", []string{"exists"}, []driver.Value{enrolled})
+			fake.OnExec("INSERT INTO mfa_challenges", 1)
+			fake.OnQuery("array_agg", []string{"roles", "perms"}, []driver.Value{"{author}", "{posts:write}"})
+			fake.OnExec("SET deletion_scheduled_for = NULL", 0)
+			fake.OnQuery("INSERT INTO sessions", []string{"id"}, []driver.Value{int64(11)})
+			fake.OnExec("INSERT INTO refresh_tokens", 1)
+
+			body := `{"email":"alice@example.com","password":"correct-password1"}`
+			rec := httptest.NewRecorder()
+			loginUser(rec, httptest.NewRequest("POST", "/users/login", strings.NewReader(body)))
+
+			want := http.StatusOK
+			if enrolled {
+				want = http.StatusServiceUnavailable
+			}
+			if rec.Code != want {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, want, rec.Body.String())
+			}
+			if enrolled && (fake.Ran("INSERT INTO mfa_challenges") || fake.Ran("INSERT INTO sessions")) {
+				t.Error("enrolled account got a challenge or a session without a TOTP key")
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// Username changes, reservations and redirects (username.go)
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// errUsernameUnavailable is returned for names held or reserved by someone else
+var errUsernameUnavailable = errors.New("Username is not available")
+
+// errRenameLimited is returned when a user has changed their username too
+// often recently
+type errRenameLimited struct {
+	retryAfter time.Duration
+}
+
+func (e errRenameLimited) Error() string {
+	return "Username was changed too recently, please wait before changing it again"
+}
+
+// usernameReservation is how long an old username stays reserved for the
+// user who gave it up
+func usernameReservation() time.Duration {
+	return envDuration("USERNAME_RESERVATION_PERIOD", 90*24*time.Hour)
+}
+
+// usernameAvailable reports whether userID may take name. Names are compared
+// case-insensitively, and a name given up by another user is unavailable
+// until its reservation ends. Pass 0 for an account that does not exist yet.
+func usernameAvailable(tx *sql.Tx, name string, userID int) (bool, error) {
+	var available bool
+	err := tx.QueryRow(
+		`SELECT NOT EXISTS(SELECT 1 FROM users WHERE lower(username) = lower($1) AND id <> $2)
+			AND NOT EXISTS(SELECT 1 FROM username_history
+				WHERE lower(old_username) = lower($1) AND user_id <> $2 AND reserved_until > $3)`,
+		name, userID, clock(),
+	).Scan(&available)
+	return available, err
+}
+
+// isUsernameTaken reports whether err is the database refusing a username
+// that differs only in case from one already in use. usernameAvailable
+// checks first, but two requests for the same name can both pass it.
+func isUsernameTaken(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" &&
+		(pqErr.Constraint == "idx_users_username_lower" || pqErr.Constraint == "users_username_key")
+}
+
+// changeUsername records the user's current username in their history and
+// reserves it before the caller updates the users row in the same
+// transaction. Renames are limited to USERNAME_MAX_CHANGES per
+// USERNAME_CHANGE_WINDOW unless limited is false. sql.ErrNoRows means the
+// user does not exist.
+func changeUsername(tx *sql.Tx, userID int, name string, limited bool) error {
+	// Lock the user so concurrent renames are counted one after another
+	var current string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&current); err != nil {
+		return err
+	}
+	if name == current {
+		return nil
+	}
+
+	now := clock()
+	if limited {
+		window := envDuration("USERNAME_CHANGE_WINDOW", 30*24*time.Hour)
+		rows, err := tx.Query(
+			"SELECT changed_at FROM username_history WHERE user_id = $1 AND changed_at > $2 ORDER BY changed_at DESC",
+			userID, now.Add(-window),
+		)
+		if err != nil {
+			return err
+		}
+		var recent []time.Time
+		for rows.Next() {
+			var changedAt time.Time
+			if err := rows.Scan(&changedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			recent = append(recent, changedAt)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		// Another rename is allowed once the oldest counted one leaves the window
+		if limit := envInt("USERNAME_MAX_CHANGES", 2); len(recent) >= limit {
+			return errRenameLimited{retryAfter: recent[limit-1].Add(window).Sub(now)}
+		}
+	}
+
+	available, err := usernameAvailable(tx, name, userID)
+	if err != nil {
+		return err
+	}
+	if !available {
+		return errUsernameUnavailable
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO username_history (user_id, old_username, changed_at, reserved_until) VALUES ($1, $2, $3, $4)",
+		userID, current, now, now.Add(usernameReservation()),
+	)
+	return err
+}
+
+// writeUsernameError responds to an error from changeUsername
+func writeUsernameError(w http.ResponseWriter, err error) {
+	if limited, ok := err.(errRenameLimited); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.retryAfter.Seconds()))))
+		http.Error(w, limited.Error(), http.StatusTooManyRequests)
+		return
+	}
+	switch err {
+	case errUsernameUnavailable:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case sql.ErrNoRows:
+		http.Error(w, "User not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Error changing username: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// getUserByUsername returns the profile of the user with the given name.
+// A name the user has since changed redirects to their current one, so old
+// links keep working.
+func getUserByUsername(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	user, err := scanUserProfile(db.QueryRow(
+		"SELECT "+userProfileColumns+" FROM users WHERE lower(username) = lower($1) AND deletion_scheduled_for IS NULL",
+		name,
+	))
+	if err == nil {
+		writeUserProfile(w, r, user)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The most recent user to give up the name is the one it points to
+	var current string
+	err = db.QueryRow(
+		`SELECT u.username FROM username_history h JOIN users u ON u.id = h.user_id
+		WHERE lower(h.old_username) = lower($1) AND u.deletion_scheduled_for IS NULL
+		ORDER BY h.changed_at DESC LIMIT 1`,
+		name,
+	).Scan(&current)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Not permanent: the old name may be taken by someone else later
+	http.Redirect(w, r, "/users/by-username/"+url.PathEscape(current), http.StatusFound)
+}
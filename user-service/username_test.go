@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// usernameTakenErr is what Postgres reports when another account took a
+// name between the availability check and the write
+var usernameTakenErr = &pq.Error{Code: "23505", Constraint: "idx_users_username_lower"}
+
+func TestChangeUsername(t *testing.T) {
+	tokens = testTokenConfig()
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		auth        string
+		recent      [][]driver.Value
+		available   bool
+		updateErr   error
+		wantStatus  int
+		wantHistory bool
+	}{
+		{"rename", bearer(t, 1), nil, true, nil, http.StatusOK, true},
+		{"name taken or reserved", bearer(t, 1), nil, false, nil, http.StatusConflict, false},
+		{"name taken concurrently", bearer(t, 1), nil, true, usernameTakenErr, http.StatusConflict, true},
+		{"too many renames", bearer(t, 1), [][]driver.Value{{now.Add(-time.Hour)}, {now.Add(-48 * time.Hour)}}, true, nil, http.StatusTooManyRequests, false},
+		{"user manager is not limited", bearer(t, 3, "users:manage"), [][]driver.Value{{now.Add(-time.Hour)}, {now.Add(-48 * time.Hour)}}, true, nil, http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("FOR UPDATE", []string{"username"}, []driver.Value{"alice"})
+			fake.OnQuery("SELECT changed_at", []string{"changed_at"}, tt.recent...)
+			fake.OnQuery("SELECT NOT EXISTS", []string{"available"}, []driver.Value{tt.available})
+			fake.OnExec("INSERT INTO username_history", 1)
+			if tt.updateErr != nil {
+				fake.OnError("UPDATE users", tt.updateErr)
+			}
+			fake.OnQuery("UPDATE users", []string{"email_changed"}, []driver.Value{false})
+			fake.OnQuery("SELECT id, username, email", profileColumns, profileRow(1, false))
+
+			req := httptest.NewRequest("PUT", "/users/1", strings.NewReader(`{"username":"alice2"}`))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			req.Header.Set("Authorization", tt.auth)
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(updateUser)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if got := fake.Ran("INSERT INTO username_history"); got != tt.wantHistory {
+				t.Errorf("recorded history = %v, want %v", got, tt.wantHistory)
+			}
+			if fake.Ran("UPDATE users") != (tt.wantStatus == http.StatusOK || tt.updateErr != nil) {
+				t.Errorf("ran UPDATE users = %v", fake.Ran("UPDATE users"))
+			}
+			// The older rename leaves the 30 day window in 28 days
+			if tt.wantStatus == http.StatusTooManyRequests {
+				if retry := rec.Header().Get("Retry-After"); retry != "2419200" {
+					t.Errorf("Retry-After = %q", retry)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterUsernameTakenConcurrently(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.OnQuery("SELECT NOT EXISTS", []string{"available"}, []driver.Value{true})
+	fake.OnError("INSERT INTO users", usernameTakenErr)
+
+	body := `{"username":"Alice","email":"alice2@example.com","password":"correct horse battery 7"}`
+	rec := httptest.NewRecorder()
+	createUser(rec, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), errUsernameUnavailable.Error()) {
+		t.Errorf("status = %d (%s), want %d", rec.Code, rec.Body.String(), http.StatusConflict)
+	}
+}
+
+func TestGetUserByUsername(t *testing.T) {
+	tests := []struct {
+		name         string
+		current      [][]driver.Value
+		history      [][]driver.Value
+		wantStatus   int
+		wantLocation string
+	}{
+		{"current name", [][]driver.Value{profileRow(1, false)}, nil, http.StatusOK, ""},
+		{"old name", nil, [][]driver.Value{{"alice"}}, http.StatusFound, "/users/by-username/alice"},
+		{"unknown name", nil, nil, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("WHERE lower(username)", profileColumns, tt.current...)
+			fake.OnQuery("FROM username_history", []string{"username"}, tt.history...)
+			fake.OnQuery("FROM follows", []string{"followers", "following"}, []driver.Value{int64(0), int64(0)})
+
+			req := httptest.NewRequest("GET", "/users/by-username/alice_old", nil)
+			req = mux.SetURLVars(req, map[string]string{"name": "alice_old"})
+			rec := httptest.NewRecorder()
+			authn.OptionalAuth(getUserByUsername)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if location := rec.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", location, tt.wantLocation)
+			}
+		})
+	}
+}
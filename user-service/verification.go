@@ -0,0 +1,177 @@
+// Email verification (verification.go)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"blog-shared/auth"
+)
+
+// emailVerificationTTL returns how long verification links stay valid
+func emailVerificationTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("EMAIL_VERIFICATION_TTL", "48h"))
+	if err != nil {
+		return 48 * time.Hour
+	}
+	return ttl
+}
+
+// verificationResendInterval returns the minimum time between verification emails
+func verificationResendInterval() time.Duration {
+	interval, err := time.ParseDuration(getEnv("EMAIL_VERIFICATION_RESEND_INTERVAL", "1m"))
+	if err != nil {
+		return time.Minute
+	}
+	return interval
+}
+
+// createVerificationToken replaces any outstanding verification tokens for
+// the user with a new one and returns it
+func createVerificationToken(userID int) (string, error) {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM email_verification_tokens WHERE user_id = $1 AND used_at IS NULL", userID)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO email_verification_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		userID, hash, time.Now().Add(emailVerificationTTL()),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// sendVerificationEmail emails a verification link to the user
+func sendVerificationEmail(userID int, email, token string) {
+	msg := Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf(
+			"Please confirm this email address by opening the link below within %s:\n\n"+
+				"%s/users/verify?token=%s\n\n"+
+				"If you didn't request this, you can ignore this email.\n",
+			emailVerificationTTL(), getEnv("PUBLIC_API_URL", "http://localhost:8081"), url.QueryEscape(token),
+		),
+	}
+	if err := mailer.Send(msg); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", userID, err)
+	}
+}
+
+// verifyEmail confirms an email address using the token from the verification link
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT id, user_id, expires_at, used_at FROM email_verification_tokens WHERE token_hash = $1 FOR UPDATE",
+		hashToken(token),
+	).Scan(&tokenID, &userID, &expiresAt, &usedAt)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || usedAt.Valid || time.Now().After(expiresAt) {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+
+	if _, err = tx.Exec("UPDATE email_verification_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP) WHERE id = $1",
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Error verifying email: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified"})
+}
+
+// resendVerification sends a fresh verification email to the caller, at most
+// once per EMAIL_VERIFICATION_RESEND_INTERVAL
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+
+	var email string
+	var verifiedAt, lastSentAt sql.NullTime
+	err := db.QueryRow(
+		`SELECT u.email, u.email_verified_at, (SELECT MAX(created_at) FROM email_verification_tokens WHERE user_id = u.id)
+		FROM users u WHERE u.id = $1`,
+		claims.UserID,
+	).Scan(&email, &verifiedAt, &lastSentAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if verifiedAt.Valid {
+		http.Error(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+
+	if lastSentAt.Valid {
+		if wait := time.Until(lastSentAt.Time.Add(verificationResendInterval())); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Verification email was sent recently, please wait before trying again", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	token, err := createVerificationToken(claims.UserID)
+	if err != nil {
+		http.Error(w, "Error creating verification token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go sendVerificationEmail(claims.UserID, email, token)
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResendVerification(t *testing.T) {
+	tokens = testTokenConfig()
+	mailer = &recordingMailer{}
+	columns := []string{"email", "email_verified_at", "last_sent_at"}
+
+	tests := []struct {
+		name       string
+		row        []driver.Value
+		wantStatus int
+	}{
+		{"never sent", []driver.Value{"a@example.com", nil, nil}, http.StatusAccepted},
+		{"sent long ago", []driver.Value{"a@example.com", nil, time.Now().Add(-time.Hour)}, http.StatusAccepted},
+		{"sent just now", []driver.Value{"a@example.com", nil, time.Now()}, http.StatusTooManyRequests},
+		{"already verified", []driver.Value{"a@example.com", time.Now(), nil}, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t)
+			fake.OnQuery("SELECT u.email", columns, tt.row)
+			fake.OnExec("email_verification_tokens", 1)
+
+			req := httptest.NewRequest("POST", "/users/verify/resend", nil)
+			req.Header.Set("Authorization", bearer(t, 1))
+			rec := httptest.NewRecorder()
+			authn.RequireAuth(resendVerification)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+				t.Error("missing Retry-After header")
+			}
+		})
+	}
+}